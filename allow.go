@@ -0,0 +1,72 @@
+package blitz
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// Allow checks if a single request for the given queue can proceed right now, and if so uses up a slot.
+// It never waits and never reserves a slot in the future, like [golang.org/x/time/rate.Limiter.Allow].
+//
+// If the given queue has no slot available immediately, a slot is borrowed from a lower queue in the same way as for regular requests.
+// When using weights, lower queues with non-zero weight are tried in order of the lowest ratio of borrowed slots to their weight.
+// Otherwise, lower queues are tried from the highest to the lowest.
+// The limit of [WithGlobalRate] applies as well, but not the per-client limit.
+//
+// If no queue with the given index exists, returns false.
+func (blitz *Blitz) Allow(queue int) bool {
+	if queue < 0 || queue >= len(blitz.limiters) {
+		return false
+	}
+
+	now := blitz.clock.Now()
+	index := blitz.allowQueue(now, queue)
+	if index == -1 {
+		return false
+	}
+
+	// the global limit is exceeded => return the slot of the queue
+	if blitz.global != nil && !blitz.global.AllowN(now, 1) {
+		blitz.limiters[index].ReserveN(now, -1)
+		return false
+	}
+
+	if blitz.weighted && index != queue {
+		blitz.borrowed[index].Add(1)
+	}
+	return true
+}
+
+// allowQueue uses up a slot of the given queue, or a lower one, that is available at now.
+// Returns the index of the queue used, or -1 if no queue has a slot available.
+func (blitz *Blitz) allowQueue(now time.Time, queue int) int {
+	if !blitz.isClosedQueue(queue) && blitz.limiters[queue].AllowN(now, 1) {
+		return queue
+	}
+
+	// find the lower queues to borrow from, in order
+	lowest := blitz.lowestLender(queue)
+	lenders := make([]int, 0, queue-lowest)
+	for i := queue - 1; i >= lowest; i-- {
+		if blitz.isClosedQueue(i) || (blitz.weighted && blitz.queues[i].Weight == 0) {
+			continue
+		}
+		lenders = append(lenders, i)
+	}
+	if blitz.weighted {
+		ratio := func(i int) float64 {
+			return float64(blitz.borrowed[i].Load()) / float64(blitz.queues[i].Weight)
+		}
+		slices.SortStableFunc(lenders, func(i, j int) int {
+			return cmp.Compare(ratio(i), ratio(j))
+		})
+	}
+
+	for _, i := range lenders {
+		if blitz.limiters[i].AllowN(now, 1) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,53 @@
+package blitz
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Headers declaring the request a reservation is for, see [WithBindRequest].
+// Alternatively, the request can be declared using the "method" and "path" query parameters.
+const (
+	HeaderBindMethod = "X-Blitz-Method"
+	HeaderBindPath   = "X-Blitz-Path"
+)
+
+// bindingLength is the length of the hash of the request a token is bound to
+const bindingLength = 16
+
+// binding is the hash of the request a token is bound to.
+// The zero value means the token is not bound to any request.
+type binding [bindingLength]byte
+
+var (
+	errMissingBinding     = errors.New("reservation must declare the method and path of the request")
+	errReservationBinding = errors.New("reservation was issued for a different request")
+)
+
+// requestBinding computes the binding of a request with the given method and path.
+// The method is case-insensitive, and the path is cleaned before hashing.
+func requestBinding(method, p string) (b binding) {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	sum := sha256.Sum256([]byte(strings.ToUpper(method) + " " + path.Clean(p)))
+	copy(b[:], sum[:])
+	return
+}
+
+// declaredBinding computes the binding of the request declared by a request for a reservation.
+// If no request is declared, returns false.
+func declaredBinding(r *http.Request) (binding, bool) {
+	method, p := r.Header.Get(HeaderBindMethod), r.Header.Get(HeaderBindPath)
+	if method == "" && p == "" {
+		query := r.URL.Query()
+		method, p = query.Get("method"), query.Get("path")
+	}
+	if method == "" || p == "" {
+		return binding{}, false
+	}
+	return requestBinding(method, p), true
+}
@@ -1,148 +1,627 @@
 package blitz
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
 	"net/http"
+	"net/netip"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
-var errAtLeastOneQueue = errors.New("at least one queue rate must be provided")
+var (
+	errAtLeastOneQueue    = errors.New("at least one queue rate must be provided")
+	errInvalidRefill      = errors.New("refill duration must be positive")
+	errInvalidControlPath = errors.New("control path must start and end with a slash")
+	errInvalidStatus      = errors.New("reject status must be a 4xx or 5xx status code")
+	errInvalidCancel      = errors.New("cancel status must be a 4xx or 5xx status code")
+	errInvalidJitter      = errors.New("jitter must be between 0 and 1")
+	errInvalidUpgrade     = errors.New("upgrade queue does not exist")
+	errInvalidStatsWindow = errors.New("stats window must not be negative")
+	errInvalidGrace       = errors.New("confirmation grace period must not be negative")
+	errInvalidMaxPending  = errors.New("maximum number of pending confirmations must not be negative")
+	errInvalidGlobalRate  = errors.New("global rate must be positive, with a positive burst")
+	errInvalidReserveRate = errors.New("reservation rate must be positive, with a positive burst")
+	errInvalidSlack       = errors.New("valid from slack must not be negative")
+	errInvalidBorrowDepth = errors.New("borrow depth must not be negative")
+	errInvalidTTL         = errors.New("reservation ttl must not be negative")
+	errInvalidFailMode    = errors.New("fail mode must be FailClosed or FailOpen")
+)
+
+const (
+	// DefaultControlPath is the default path of the status and reservation endpoint.
+	DefaultControlPath = "/blitz/"
+
+	// DefaultRejectStatus is the default status code for requests that can not be admitted.
+	DefaultRejectStatus = http.StatusTooManyRequests
 
-// Blitz creates a new blitz server wrapping handler
+	// DefaultCancelStatus is the default status code for requests cancelled by the client while waiting.
+	// It is the non-standard "Client Closed Request" status, which clients never receive as they are gone already.
+	DefaultCancelStatus = 499
+
+	// DefaultClockSkew is the default tolerance when checking if a reservation is valid.
+	DefaultClockSkew = 250 * time.Millisecond
+)
+
+// New creates a new blitz server wrapping handler.
+//
+// It is a shorthand for [NewWithOptions] using [WithRand], [WithRefill] and [WithQueues].
+// A burst of zero makes the corresponding queue closed, see [QueueConfig].
 func New(rand io.Reader, handler http.Handler, every time.Duration, bs []uint64) (*Blitz, error) {
-	if len(bs) == 0 {
-		return nil, errAtLeastOneQueue
-	}
+	return NewWithOptions(handler, WithRand(rand), WithRefill(every), WithQueues(bs))
+}
 
+// NewWithOptions creates a new blitz server wrapping handler and configured using the given options.
+//
+// By default, a server uses [crypto/rand.Reader] as a source of randomness,
+// refills every second, and has a single queue with a burst of one.
+// Queues which do not specify their own refill duration use the one of the server.
+func NewWithOptions(handler http.Handler, opts ...Option) (*Blitz, error) {
 	blitz := &Blitz{
-		every:   every,
-		Handler: handler,
+		rand:         rand.Reader,
+		clock:        realClock{},
+		every:        time.Second,
+		queues:       []QueueConfig{{Rate: 1}},
+		control:      DefaultControlPath,
+		reject:       DefaultRejectStatus,
+		cancel:       DefaultCancelStatus,
+		closed:       make(chan struct{}),
+		skew:         DefaultClockSkew,
+		upgradeQueue: -1,
+		Handler:      handler,
+	}
+	for _, opt := range opts {
+		opt(blitz)
+	}
+	if !blitz.customSelector {
+		blitz.selector = blitz.selectQueueName
+	}
+	if blitz.rand != rand.Reader {
+		blitz.rand = &lockedReader{r: blitz.rand}
+	}
+	blitz.clock = newMonotoneClock(blitz.clock, func(step time.Duration) {
+		blitz.logEvent(event{Name: eventClockStep, Queue: -1, Delay: step, Err: errClockStep})
+	})
+	if store, ok := blitz.nonces.(*MemoryNonceStore); ok && store.Clock == nil {
+		store.Clock = blitz.clock
 	}
 
-	blitz.limiters = make([]*rate.Limiter, len(bs))
-	blitz.stats = make([]*Stats, len(bs))
-	for i, b := range bs {
-		blitz.limiters[i] = rate.NewLimiter(rate.Every(time.Second), int(b))
-		blitz.stats[i] = NewStats(10 * every)
+	if len(blitz.queues) == 0 {
+		return nil, errAtLeastOneQueue
 	}
+	if blitz.every <= 0 {
+		return nil, errInvalidRefill
+	}
+	if !strings.HasPrefix(blitz.control, "/") || !strings.HasSuffix(blitz.control, "/") {
+		return nil, errInvalidControlPath
+	}
+	if blitz.reject < 400 || blitz.reject > 599 {
+		return nil, errInvalidStatus
+	}
+	if blitz.cancel < 400 || blitz.cancel > 599 {
+		return nil, errInvalidCancel
+	}
+	if blitz.jitter < 0 || blitz.jitter > 1 {
+		return nil, errInvalidJitter
+	}
+	if blitz.upgradeQueue >= len(blitz.queues) {
+		return nil, errInvalidUpgrade
+	}
+	if blitz.statsWindow < 0 {
+		return nil, errInvalidStatsWindow
+	}
+	if blitz.confirmGrace < 0 {
+		return nil, errInvalidGrace
+	}
+	if blitz.maxPending < 0 {
+		return nil, errInvalidMaxPending
+	}
+	if blitz.validFromSlack < 0 {
+		return nil, errInvalidSlack
+	}
+	if blitz.borrowDepth < 0 {
+		return nil, errInvalidBorrowDepth
+	}
+	if blitz.reservationTTL < 0 {
+		return nil, errInvalidTTL
+	}
+	if blitz.failMode != FailClosed && blitz.failMode != FailOpen {
+		return nil, errInvalidFailMode
+	}
+	if blitz.globalRate != 0 || blitz.globalBurst != 0 {
+		if blitz.globalRate <= 0 || blitz.globalBurst <= 0 {
+			return nil, errInvalidGlobalRate
+		}
+		blitz.global = rate.NewLimiter(rate.Limit(blitz.globalRate), blitz.globalBurst)
+	}
+	if blitz.reserveRate != 0 || blitz.reserveBurst != 0 {
+		if blitz.reserveRate <= 0 || blitz.reserveBurst <= 0 {
+			return nil, errInvalidReserveRate
+		}
+		blitz.reserveLimiter = rate.NewLimiter(rate.Limit(blitz.reserveRate), blitz.reserveBurst)
+	}
+	if blitz.confirmGrace > 0 {
+		blitz.confirms = &confirmations{pending: make(map[[nonceLength]byte]*pendingReservation), limit: blitz.maxPending}
+		if blitz.confirms.limit == 0 {
+			blitz.confirms.limit = DefaultMaxPendingConfirmations
+		}
+	}
+
+	blitz.limiters = make([]*rate.Limiter, len(blitz.queues))
+	blitz.stats = make([]*Stats, len(blitz.queues))
+	blitz.counters = make([]counters, len(blitz.queues))
+	blitz.concurrent = make([]chan struct{}, len(blitz.queues))
+	blitz.borrowed = make([]atomic.Uint64, len(blitz.queues))
+	blitz.queueNames = make(map[string]int, len(blitz.queues))
+	for i, q := range blitz.queues {
+		if err := q.validate(i); err != nil {
+			return nil, err
+		}
+		if q.Name != "" {
+			if _, ok := blitz.queueNames[q.Name]; ok {
+				return nil, errInvalidQueue{Index: i, Reason: fmt.Sprintf("name %q is not unique", q.Name)}
+			}
+			blitz.queueNames[q.Name] = i
+		}
+
+		if q.Every == 0 {
+			blitz.queues[i].Every = blitz.every
+		}
+		every := blitz.queues[i].Every
+
+		if q.Weight != 0 {
+			blitz.weighted = true
+		}
+
+		blitz.limiters[i] = rate.NewLimiter(blitz.queues[i].limit(), blitz.queues[i].burst())
+		if q.MaxConcurrent > 0 {
+			blitz.concurrent[i] = make(chan struct{}, q.MaxConcurrent)
+		}
+		window := blitz.statsWindow
+		if window == 0 {
+			window = 10 * every
+		}
+		blitz.stats[i] = NewStatsWithClock(window, blitz.statsCapacity, blitz.clock)
+	}
+	blitz.backendLatency, _ = blitz.RegisterSeries(SeriesBackendLatency)
+	blitz.backendTTFB, _ = blitz.RegisterSeries(SeriesBackendTTFB)
 
-	signer, err := newSigner(rand)
+	var err error
+	blitz.signer, err = blitz.newSigner()
 	if err != nil {
 		return nil, err
 	}
-	blitz.signer = signer
+	if blitz.perQueueKeys {
+		blitz.signer, err = blitz.newQueueSigner(blitz.signer, len(blitz.queues))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if blitz.verifyCache > 0 {
+		blitz.signer = newCachingSigner(blitz.signer, blitz.clock, blitz.skew, blitz.verifyCache)
+	}
 
 	return blitz, nil
 }
 
 type Blitz struct {
-	every time.Duration // how often the rate refills
+	rand   io.Reader     // source of randomness
+	clock  Clock         // source of time
+	every  time.Duration // how often queues refill by default
+	queues []QueueConfig // configuration of each queue
 
-	// limiters and statistics for each queue
-	limiters []*rate.Limiter
-	stats    []*Stats
+	// protects the rate and refill duration of queues, which may change at runtime
+	queuesLock sync.RWMutex
 
-	signer signer
+	selector       QueueSelector  // selects the queue of each request
+	customSelector bool           // selector was set using an option
+	cost           CostFunc       // computes the cost of each request, nil if all cost one
+	queueNames     map[string]int // index of each named queue
 
-	Logger  *log.Logger
-	Handler http.Handler
-}
+	statsCapacity int           // maximum number of values held by the statistics of each queue
+	statsWindow   time.Duration // duration the statistics of each queue are held for, 0 for ten times the refill duration
 
-type Status struct {
-	Slots  []int64
-	Delays []int64
-}
+	control         string // path of the status and reservation endpoint
+	separateControl bool   // only serve the endpoint using ControlHandler
+	reject          int    // status code for requests that can not be admitted
+	cancel          int    // status code for requests cancelled by the client while waiting
 
-func (blitz *Blitz) Status() (st Status) {
-	// compute available slots for each queue
-	st.Slots = make([]int64, len(blitz.limiters))
-	for i, l := range blitz.limiters {
-		st.Slots[i] = int64(math.Floor(l.Tokens()))
-	}
+	failMode FailMode // how to handle requests that can not be decided on due to internal errors
 
-	// compute the average delay for each queue
-	st.Delays = make([]int64, len(blitz.limiters))
-	for i, s := range blitz.stats {
-		a, _ := s.Average().Int64()
-		st.Delays[i] = time.Duration(a).Milliseconds()
-	}
+	corsOrigins []string // origins allowed to make cross-origin requests to the endpoint, "*" for any
 
-	return
+	// limiters, statistics and counters for each queue
+	limiters []*rate.Limiter
+	stats    []*Stats
+	counters []counters
+
+	// additional statistics of each queue, in the order they were registered
+	seriesLock     sync.RWMutex
+	series         []*Series
+	backendLatency *Series
+	backendTTFB    *Series
+
+	// semaphores limiting the concurrent requests of each queue, nil for queues without a limit
+	concurrent []chan struct{}
+
+	// limiter shared by all queues, nil unless enabled
+	global      *rate.Limiter
+	globalRate  float64 // requests per second admitted across all queues, 0 if unlimited
+	globalBurst int     // burst of the global limiter
+
+	weighted        bool            // lend slots proportionally to queue weights
+	randomDowngrade bool            // pick lower queues randomly, weighted by their inverse delay
+	borrowDepth     int             // number of lower queues requests may be admitted into, 0 for all
+	borrowed        []atomic.Uint64 // number of slots lent by each queue
+
+	clients        *clientLimiters // limiters for each client, nil unless enabled
+	trustProxy     bool            // trust the X-Forwarded-For header of all requests to identify clients
+	trustedProxies []netip.Prefix  // proxies whose X-Forwarded-For header is trusted
+	forwardedFirst bool            // use the first X-Forwarded-For entry instead of the rightmost untrusted one
+
+	forwardHeaders bool // tell the handler about the queue and delay using headers
+	forwardQueue   bool // tell the handler about the queue using a header
+	forwardExpires bool // tell the handler when the reservation of a request expires using a header
+	forwardClient  bool // tell the handler about the client using the X-Forwarded-For and X-Real-IP headers
+
+	strictQueueHeader bool // reject requests with an invalid queue header, rather than using queue 0
+
+	reservationQuery  string // name of the query parameter to read reservations from, if any
+	reservationCookie string // name of the cookie to read reservations from, if any
+
+	// limiter of the reservation endpoint itself, nil unless enabled
+	reserveLimiter *rate.Limiter
+	reserveRate    float64 // reservation requests per second, 0 if unlimited
+	reserveBurst   int     // burst of the reservation limiter
+
+	skew                time.Duration // tolerance when checking if a reservation is valid
+	validFromSlack      time.Duration // duration reservations without a delay are valid before being issued
+	maxReservationDelay time.Duration // maximum delay of reservations, 0 if unlimited
+	reservationTTL      time.Duration // duration reservations are valid for, 0 for the refill duration of their queue
+
+	keyFile        string     // file to persist the signing keypair in, if any
+	verifyKeyFiles []string   // key files of additional public keys to accept reservations from
+	verifyKeys     [][32]byte // additional public keys to accept reservations from
+	hmacKey        []byte     // key to sign reservations with using hmac, nil to use nacl
+	hmacTagLength  int        // length of hmac tags, 0 for the default
+	signer         signer
+	remoteSigner   Signer     // signs reservations outside of blitz, nil to sign them using a local key
+	nonces         NonceStore // store for used nonces, nil unless in single-use mode
+	perQueueKeys   bool       // sign reservations of each queue with a separate key
+	verifyCache    int        // maximum number of verified reservations to cache, 0 to verify every use
+	bindRequest    bool       // bind reservations to the method and path of a request
+	observeOnly    bool       // record delays and rejections, but forward all requests immediately
+
+	confirmGrace time.Duration  // time to confirm reservations in, 0 if reservations need not be confirmed
+	confirms     *confirmations // reservations that have to be confirmed, nil unless confirmGrace is set
+	maxPending   int            // maximum number of reservations waiting to be confirmed, 0 for DefaultMaxPendingConfirmations
+
+	jitter float64 // fraction of the refill duration to randomly add to non-zero delays
+
+	upgradeQueue  int  // queue for requests upgrading the connection, -1 to select it like any other request
+	upgradeBypass bool // forward requests upgrading the connection without waiting
+
+	tracer     Tracer     // tracer to trace requests with, nil if disabled
+	propagator Propagator // propagator to read and write trace context, nil if disabled
+
+	maxHold    time.Duration // maximum delay to hold a request for, 0 if unlimited
+	maxWaiters int           // maximum number of requests waiting at once, 0 if unlimited
+	waiters    atomic.Int64  // number of requests currently waiting
+
+	// state for shutting down
+	lifecycle sync.Mutex
+	draining  bool           // set once shutting down
+	requests  sync.WaitGroup // requests waiting or being forwarded
+	closed    chan struct{}  // closed once the server is closed
+	closeOnce sync.Once
+
+	Logger  *log.Logger
+	Handler http.Handler
+
+	// LogLevel is the minimum level of events logged using Logger.
+	// It defaults to [slog.LevelInfo], which omits the delay of every reserved and forwarded request; set it to [slog.LevelDebug] to include them.
+	LogLevel slog.Level
+
+	// SlogLogger, if non-nil, is used to emit structured log records instead of using Logger.
+	// Its handler decides which levels are logged, LogLevel is not used.
+	SlogLogger *slog.Logger
+
+	// OnReject, if non-nil, is called instead of writing the built-in response when a request can not be admitted.
+	// The queue and delay of the request can be retrieved using [QueueFromContext] and [DelayFromContext].
+	OnReject http.Handler
+
+	// AdmitHook, if non-nil, is called whenever a request without a reservation is admitted, and whenever a reservation is issued.
+	// It receives the index of the queue used and the delay, before the request waits for it.
+	//
+	// AdmitHook and RejectHook allow observing decisions, for example for accounting or alerting, without parsing logs.
+	// They are called synchronously on the request path, and must return quickly; hand off any slow work to another goroutine.
+	AdmitHook func(queue int, delay time.Duration, r *http.Request)
+
+	// RejectHook, if non-nil, is called whenever a request without a reservation is rejected, and whenever a reservation is denied.
+	// The reason is one of the Code constants, such as [CodeQueueFull] or [CodeDelayTooLong].
+	// In observe only mode, it is called even though the request is forwarded anyways.
+	RejectHook func(reason string, r *http.Request)
+
+	// ReservationAuth, if non-nil, is called before issuing a reservation.
+	// If it returns false, the client receives [net/http.StatusUnauthorized] instead.
+	// Requests without a reservation are not affected.
+	ReservationAuth func(r *http.Request) bool
+
+	// StatusAuth is like ReservationAuth, but is called before serving the status.
+	StatusAuth func(r *http.Request) bool
+
+	// ConfigAuth, if non-nil, enables changing the rate of queues by posting to the configuration endpoint.
+	// It is called before changing the configuration, and should only return true for operators.
+	ConfigAuth func(r *http.Request) bool
 }
 
 const (
 	HeaderReservation = "X-Blitz-Reservation"
-	HeaderQueue       = "X-Blitz-Queue"
+
+	// HeaderQueue selects the queue of a request, by index or name.
+	// A request using a reservation may claim the queue the reservation was issued for, or a higher one,
+	// as requests claiming a higher queue may have been downgraded when reserving; it may never claim a lower one.
+	// Without the header, and unless a custom selector is set, a reservation is accepted for whichever queue it was issued for.
+	HeaderQueue = "X-Blitz-Queue"
+
+	HeaderCount        = "X-Blitz-Count"
+	HeaderWaited       = "X-Blitz-Waited-Ms"
+	HeaderTokenExpires = "X-Blitz-Token-Expires"
 )
 
-func (wrap *Blitz) logF(fmt string, args ...any) {
-	if wrap.Logger == nil {
-		log.Printf(fmt, args...)
+func (blitz *Blitz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !blitz.separateControl && blitz.isControlPath(r.URL.Path) {
+		blitz.serveControl(w, r)
 		return
 	}
-	wrap.Logger.Printf(fmt, args...)
-}
 
-// getQueueHeader returns the header indicating the current queue.
-// If no such header is present, it is of invalid format, or in-bounds checking fails, returns 0.
-func (blitz *Blitz) getQueueHeader(r *http.Request) int {
-	header := r.Header.Get(HeaderQueue)
-	value, err := strconv.ParseInt(header, 10, 64)
-	if err != nil {
-		return 0
+	// reject new requests when shutting down
+	if !blitz.enter() {
+		blitz.serveUnavailable(w, r)
+		return
 	}
-	if value < 0 || value >= int64(len(blitz.limiters)) {
-		return 0
+	defer blitz.leave()
+
+	// trace the admission of the request
+	r = blitz.startSpan(r, spanAdmit)
+	defer endSpan(r)
+
+	// the client asked for a queue that does not exist => tell it
+	if err := blitz.checkQueueHeader(r); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidQueue, fmt.Sprintf("Bad Request: %v", err), 0)
+		return
 	}
-	return int(value)
-}
 
-func (blitz *Blitz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/blitz/" {
-		switch r.Method {
-		case http.MethodGet:
-			blitz.serveStatus(w, r)
-		case http.MethodPost:
-			blitz.serveReservation(w, r)
-		default:
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-		}
+	// upgrading the connection => don't hold it in a timer
+	if blitz.upgradeBypass && isUpgrade(r) {
+		blitz.serveUpgrade(w, r)
 		return
 	}
 
 	// passing the 'X-Blitz-Reservation' indicates that we reserved in the past.
 	// we trust that the client has delayed accordingly.
-	if reservation := r.Header.Get(HeaderReservation); reservation != "" {
+	if reservation := blitz.findReservation(r); reservation != "" {
 		blitz.serveUseReservation(reservation, w, r)
 		return
 	}
 
 	blitz.serveRegular(w, r)
+}
+
+// ControlHandler returns a handler serving only the status and reservation endpoint.
+// Requests to other paths receive [net/http.StatusNotFound].
+//
+// Together with [WithSeparateControl], this allows serving the endpoint on a different server than proxied requests,
+// for example one that is only reachable from an internal network.
+func (blitz *Blitz) ControlHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !blitz.isControlPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		blitz.serveControl(w, r)
+	})
+}
+
+// isControlPath checks if the given path belongs to the status and reservation endpoint.
+func (blitz *Blitz) isControlPath(path string) bool {
+	switch path {
+	case blitz.control, blitz.control + healthPath, blitz.control + configPath, blitz.control + confirmPath, blitz.control + publicKeyPath:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveControl serves a request to the status and reservation endpoint.
+func (blitz *Blitz) serveControl(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(HeaderProtocol, strconv.Itoa(ProtocolVersion))
+	blitz.setCORSHeaders(w, r)
+	if !acceptsProtocol(r) {
+		writeError(w, r, http.StatusNotAcceptable, CodeNotAcceptable, "Not Acceptable: unsupported protocol version", 0)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		blitz.serveOptions(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case blitz.control + healthPath:
+		blitz.serveHealth(w, r)
+		return
+	case blitz.control + configPath:
+		blitz.serveConfig(w, r)
+		return
+	case blitz.control + confirmPath:
+		blitz.serveConfirm(w, r)
+		return
+	case blitz.control + publicKeyPath:
+		blitz.servePublicKey(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		blitz.serveStatus(w, r)
+	case http.MethodPost:
+		blitz.serveReservation(w, r)
+	case http.MethodDelete:
+		blitz.serveReset(w, r)
+	default:
+		serveMethodNotAllowed(w, r)
+	}
+}
+
+// controlMethods returns the methods supported by the control endpoint at the given path.
+// HEAD is supported wherever GET is, and responds without a body.
+// DELETE, which resets the statistics, is only supported when [Blitz.ConfigAuth] is set.
+func (blitz *Blitz) controlMethods(path string) []string {
+	switch path {
+	case blitz.control + healthPath, blitz.control + publicKeyPath:
+		return []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	case blitz.control + configPath, blitz.control + confirmPath:
+		return []string{http.MethodPost, http.MethodOptions}
+	default:
+		methods := []string{http.MethodGet, http.MethodHead, http.MethodPost}
+		if blitz.ConfigAuth != nil {
+			methods = append(methods, http.MethodDelete)
+		}
+		return append(methods, http.MethodOptions)
+	}
+}
 
+// serveOptions responds to an OPTIONS request to the control endpoint with the methods supported at its path.
+func (blitz *Blitz) serveOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", strings.Join(blitz.controlMethods(r.URL.Path), ", "))
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (blitz *Blitz) serveStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(blitz.Status())
+	if blitz.StatusAuth != nil && !blitz.StatusAuth(r) {
+		serveUnauthorized(w, r)
+		return
+	}
+
+	writeJSON(w, r, blitz.Status())
+}
+
+// serveUnauthorized rejects a request to the control endpoint that was denied by an authentication hook.
+func serveUnauthorized(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized", 0)
+}
+
+// serveMethodNotAllowed rejects a request to an endpoint not supporting its method.
+func serveMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method Not Allowed", 0)
 }
 
 func (blitz *Blitz) serveReservation(w http.ResponseWriter, r *http.Request) {
+	if blitz.ReservationAuth != nil && !blitz.ReservationAuth(r) {
+		serveUnauthorized(w, r)
+		return
+	}
+
+	if blitz.isDraining() {
+		blitz.serveUnavailable(w, r)
+		return
+	}
+
+	// too many reservation requests => reject before doing any work
+	if blitz.reserveLimiter != nil && !blitz.reserveLimiter.AllowN(blitz.clock.Now(), 1) {
+		blitz.rejected(CodeRateLimited, r)
+		blitz.serveTooManyReservations(w)
+		return
+	}
+
+	r = blitz.startSpan(r, spanReserve)
+	defer endSpan(r)
+
+	// bind the reservation to the declared request
+	var bind binding
+	if blitz.bindRequest {
+		var ok bool
+		if bind, ok = declaredBinding(r); !ok {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Bad Request: %v", errMissingBinding), 0)
+			return
+		}
+	}
+
+	queue := blitz.selectQueue(r)
+	client := blitz.clientAddr(r)
+
+	// reserve slots for each of the requests
+	var reservation Reservation
+	var err error
+	count, ok := blitz.reservationCount(r)
+	cost := blitz.requestCost(r)
+	switch {
+	case blitz.checkQueueHeader(r) != nil:
+		reservation.fail(CodeInvalidQueue)
+	case !ok || count > blitz.maxBurst(queue)/cost:
+		// compared before multiplying, so that large counts can not overflow
+		reservation.fail(CodeInvalidCount)
+	case count*cost < 1:
+		reservation.fail(CodeInvalidCount)
+	default:
+		reservation, err = blitz.signReservation(queue, client, count*cost, bind)
+		reservation.Count = count
+	}
+	if err != nil {
+		if !blitz.failOpen(eventSignFailed, client, queue, err) {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Internal Server Error: failed to sign reservation", 0)
+			return
+		}
+
+		// failing open => tell the client to send its request right away without a reservation, where it is admitted as usual
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Reservation{
+			Success:                true,
+			Code:                   CodeUnsigned,
+			Message:                codeMessages[CodeUnsigned],
+			Queue:                  queue,
+			Count:                  count,
+			SendAtUnixMilliseconds: blitz.clock.Now().UnixMilli(),
+		})
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	reservation := blitz.signReservation(blitz.getQueueHeader(r))
+
+	switch reservation.Code {
+	case CodeDelayTooLong, CodeRateLimited:
+		// the delay is too long, or too many reservations are pending => tell the client when to try again
+		retry := time.Duration(reservation.RetryAfterMs) * time.Millisecond
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retry.Seconds())), 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+	case CodeQueueFull:
+		w.WriteHeader(blitz.reject)
+	case CodeInvalidQueue, CodeInvalidCount:
+		w.WriteHeader(http.StatusBadRequest)
+	}
 
 	// if the reservation was a success,
 	if reservation.Success {
 		delay := time.Duration(reservation.DelayInMilliseconds * int64(time.Millisecond))
-		blitz.logF("client %q on queue %d delay %s", r.RemoteAddr, reservation.Queue, delay)
+		blitz.logEvent(event{Name: eventReserve, Client: client, Queue: reservation.Queue, Delay: delay})
 		blitz.stats[reservation.Queue].AddInt64(delay.Nanoseconds())
+		blitz.counters[reservation.Queue].issued.Add(1)
+		traceAdmission(r, reservation.Queue, delay)
+		blitz.admitted(reservation.Queue, delay, r)
+	} else {
+		traceRejection(r)
+		blitz.rejected(reservation.Code, r)
 	}
 
 	json.NewEncoder(w).Encode(reservation)
@@ -150,58 +629,324 @@ func (blitz *Blitz) serveReservation(w http.ResponseWriter, r *http.Request) {
 
 func (blitz *Blitz) serveUseReservation(reservation string, w http.ResponseWriter, r *http.Request) {
 	// validate the request
-	if err := blitz.useReservation(r.Context(), reservation); err != nil {
-		blitz.logF("client %q bad reservation: %v", r.RemoteAddr, err)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Bad Request: %v\n", err)
+	start := blitz.clock.Now()
+	var bind binding
+	if blitz.bindRequest {
+		bind = requestBinding(r.Method, r.URL.Path)
+	}
 
+	t, err := blitz.useReservation(r.Context(), reservation, blitz.claimedQueue(r), bind, blitz.clientAddr(r))
+	switch {
+	case errors.Is(err, errClosed):
+		blitz.serveUnavailable(w, r)
+		return
+	case errors.Is(err, errNonceStore):
+		// failing closed => the reservation itself may be fine, so this is not the fault of the client
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "Service Unavailable: failed to check reservation", 0)
+		return
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// the client is gone while waiting for the reservation => it was not a bad one
+		blitz.serveCancelled(w, r, err)
 		return
 	}
+	if err != nil {
+		blitz.logEvent(event{Name: eventBadReservation, Client: blitz.clientAddr(r), Queue: -1, Err: err})
 
-	// delete the special headers
-	r.Header.Del(HeaderReservation)
-	r.Header.Del(HeaderQueue)
+		// expired => tell the client when to reserve again
+		var expired errReservationExpired
+		if errors.As(err, &expired) {
+			blitz.serveExpired(w, expired)
+			return
+		}
+
+		writeError(w, r, http.StatusBadRequest, CodeBadReservation, fmt.Sprintf("Bad Request: %v", err), 0)
+
+		return
+	}
 
 	// and forward the request
-	blitz.Handler.ServeHTTP(w, r)
+	waited := blitz.clock.Now().Sub(start)
+	r = r.WithContext(withExpires(r.Context(), t.Until))
+	blitz.counters[t.Queue].used.Add(1)
+	traceAdmission(r, t.Queue, waited)
+	blitz.forward(w, r, t.Queue, waited)
 }
 
-func (blitz *Blitz) serveRegular(w http.ResponseWriter, r *http.Request) {
-	reservation, index := blitz.reserve(blitz.getQueueHeader(r))
-	if index == -1 {
-		blitz.logF("client %q delay ∞", r.RemoteAddr)
-		w.WriteHeader(http.StatusBadGateway)
-		io.WriteString(w, "∞ delay")
+// serveCancelled responds to a request whose context was done while it was waiting.
+// If its deadline passed, it receives [net/http.StatusRequestTimeout].
+// Otherwise the client is gone, so don't report a gateway error.
+func (blitz *Blitz) serveCancelled(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, r, http.StatusRequestTimeout, CodeTimeout, "Request Timeout", 0)
+		return
+	}
+	writeError(w, r, blitz.cancel, CodeCancelled, "Request cancelled by client", 0)
+}
+
+// serveExpired tells a client using an expired reservation when to make a new one.
+func (blitz *Blitz) serveExpired(w http.ResponseWriter, expired errReservationExpired) {
+	rs := Reservation{Queue: expired.Queue}
+	rs.fail(CodeExpired)
+	w.Header().Set(HeaderProtocol, strconv.Itoa(ProtocolVersion))
+
+	delay := blitz.estimateDelay(expired.Queue, 1, blitz.clock.Now())
+	if delay != rate.InfDuration {
+		rs.RetryAfterMs = delay.Milliseconds()
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(delay.Seconds())), 10))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(rs)
+}
+
+// enterWaiting registers a request that is about to wait for its delay in the given queue.
+// If the maximum number of waiting requests of the server or the queue is reached, returns false and does not register the request.
+func (blitz *Blitz) enterWaiting(queue int) bool {
+	waiting := &blitz.counters[queue].waiting
+	if limit := blitz.queues[queue].MaxQueueLength; waiting.Add(1) > int64(limit) && limit > 0 {
+		waiting.Add(-1)
+		return false
+	}
+
+	if blitz.maxWaiters <= 0 {
+		return true
+	}
+	if blitz.waiters.Add(1) > int64(blitz.maxWaiters) {
+		blitz.waiters.Add(-1)
+		waiting.Add(-1)
+		return false
+	}
+	return true
+}
 
+// leaveWaiting marks a request registered with enterWaiting as done waiting.
+func (blitz *Blitz) leaveWaiting(queue int) {
+	blitz.counters[queue].waiting.Add(-1)
+	if blitz.maxWaiters > 0 {
+		blitz.waiters.Add(-1)
+	}
+}
+
+func (blitz *Blitz) serveRegular(w http.ResponseWriter, r *http.Request) {
+	queue := blitz.selectQueue(r)
+	client := blitz.clientAddr(r)
+	cost := blitz.requestCost(r)
+	admission, code := blitz.admit(queue, client, cost)
+	if code != "" {
+		blitz.serveReject(w, r, queue, code)
 		return
 	}
+	index := admission.Queue
 
 	// check that we have a finite delay to wait
-	delay := reservation.Delay()
+	delay := admission.Delay()
 	if delay == rate.InfDuration {
-		blitz.logF("client %q delay ∞", r.RemoteAddr)
+		admission.Cancel()
+		blitz.serveReject(w, r, index, CodeQueueFull)
+		return
+	}
+	if delay > 0 {
+		delay += blitz.jitterDelay(index)
+	}
+
+	// delay too long => don't hold the request
+	if blitz.maxHold > 0 && delay > blitz.maxHold {
+		admission.Cancel()
+		blitz.serveHoldExceeded(w, r, index, delay)
+		return
+	}
+
+	// only observing => record the delay, but don't actually wait
+	wait := delay
+	if blitz.observeOnly {
+		wait = 0
+	}
 
-		w.WriteHeader(http.StatusBadGateway)
-		io.WriteString(w, "∞ delay")
+	// too many requests waiting already => reject immediately
+	if wait > 0 && !blitz.enterWaiting(index) {
+		admission.Cancel()
+		blitz.rejected(CodeUnavailable, r)
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "Service Unavailable: too many waiting requests", 0)
 		return
 	}
 
 	// log the delay
-	blitz.logF("client %q on queue %d delay %s", r.RemoteAddr, index, delay)
+	traceAdmission(r, index, delay)
+	blitz.logEvent(event{Name: eventForward, Client: client, Queue: index, Delay: delay})
 	blitz.stats[index].AddInt64(delay.Nanoseconds())
+	blitz.admitted(index, delay, r)
 
-	// wait for the delay or the request to expire
+	// wait for the delay, the request to expire or the server to close
 	// whichever happens first
-	select {
-	case <-r.Context().Done():
-		w.WriteHeader(http.StatusBadGateway)
-		io.WriteString(w, "Request cancelled by client")
-	case <-time.After(delay):
-		// delete the special headers
-		r.Header.Del(HeaderReservation)
-		r.Header.Del(HeaderQueue)
-
-		// and forward
-		blitz.Handler.ServeHTTP(w, r)
+	err := blitz.wait(r.Context(), wait)
+	if wait > 0 {
+		blitz.leaveWaiting(index)
 	}
+
+	switch {
+	case errors.Is(err, errClosed):
+		blitz.serveUnavailable(w, r)
+	case err != nil:
+		blitz.serveCancelled(w, r, err)
+	default:
+		blitz.counters[index].forwarded.Add(1)
+		blitz.forward(w, r, index, wait)
+	}
+}
+
+// forward forwards a request admitted into the given queue after waiting for the given duration to the handler.
+func (blitz *Blitz) forward(w http.ResponseWriter, r *http.Request, queue int, waited time.Duration) {
+	// wait until the queue has fewer concurrent requests than its limit.
+	// requests that are only observed or bypass the queue are counted, but never wait.
+	limit := !blitz.observeOnly && !(blitz.upgradeBypass && isUpgrade(r))
+	start := blitz.clock.Now()
+	switch err := blitz.acquireConcurrent(r.Context(), queue, limit); {
+	case errors.Is(err, errClosed):
+		blitz.serveUnavailable(w, r)
+		return
+	case err != nil:
+		blitz.serveCancelled(w, r, err)
+		return
+	}
+	defer blitz.releaseConcurrent(queue, limit)
+	waited += blitz.clock.Now().Sub(start)
+
+	// delete the special headers
+	r.Header.Del(HeaderReservation)
+	r.Header.Del(HeaderQueue)
+	r.Header.Del(HeaderTokenExpires)
+
+	// tell the handler about the queue and delay
+	if blitz.forwardHeaders || blitz.forwardQueue {
+		r.Header.Set(HeaderQueue, strconv.Itoa(queue))
+	}
+	if blitz.forwardHeaders {
+		r.Header.Set(HeaderWaited, strconv.FormatInt(waited.Milliseconds(), 10))
+	}
+	if expires, ok := ExpiresFromContext(r.Context()); ok && blitz.forwardExpires {
+		r.Header.Set(HeaderTokenExpires, strconv.FormatInt(expires.UnixMilli(), 10))
+	}
+	if blitz.forwardClient {
+		blitz.setClientHeaders(r)
+	}
+	r = r.WithContext(withQueue(r.Context(), queue, waited))
+
+	// the wait is over => end the span, and pass its context on
+	endSpan(r)
+	blitz.injectSpan(r)
+
+	blitz.serveMeasured(blitz.next(r), w, r, queue)
+}
+
+// admitted calls AdmitHook, if set.
+func (blitz *Blitz) admitted(queue int, delay time.Duration, r *http.Request) {
+	if blitz.AdmitHook != nil {
+		blitz.AdmitHook(queue, delay, r)
+	}
+}
+
+// rejected calls RejectHook, if set.
+func (blitz *Blitz) rejected(reason string, r *http.Request) {
+	if blitz.RejectHook != nil {
+		blitz.RejectHook(reason, r)
+	}
+}
+
+// rejectCode returns the code of the reason a request for the given queue using up cost slots could not be admitted.
+// It is [CodeInvalidQueue] if the queue does not exist, and [CodeInvalidCount] if the request uses up more slots than any queue it may be admitted into holds.
+// In both cases, the request can never be admitted.
+// Otherwise, it is [CodeQueueFull].
+func (blitz *Blitz) rejectCode(queue, cost int) string {
+	if queue < 0 || queue >= len(blitz.limiters) {
+		return CodeInvalidQueue
+	}
+	if blitz.global != nil && cost > blitz.global.Burst() {
+		return CodeInvalidCount
+	}
+
+	// only closed queues => they are full, rather than the request being too large
+	burst := blitz.maxBurst(queue)
+	if burst == 0 || cost <= burst {
+		return CodeQueueFull
+	}
+	return CodeInvalidCount
+}
+
+// serveReject rejects a request that could not be admitted into the given queue.
+// The code tells why, and is either [CodeQueueFull] or [CodeInvalidCount], see [Blitz.rejectCode].
+func (blitz *Blitz) serveReject(w http.ResponseWriter, r *http.Request, queue int, code string) {
+	blitz.logEvent(event{Name: eventReject, Client: blitz.clientAddr(r), Queue: queue, Delay: rate.InfDuration})
+	blitz.counters[queue].rejected.Add(1)
+	traceRejection(r)
+	blitz.rejected(code, r)
+
+	// only observing => forward anyways
+	if blitz.observeOnly {
+		blitz.forward(w, r, queue, 0)
+		return
+	}
+
+	// tell the client when to try again, unless the request can never be admitted
+	retry, ok := blitz.retryAfter(queue)
+	if ok && code == CodeQueueFull {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retry.Seconds())), 10))
+	}
+
+	if blitz.OnReject != nil {
+		blitz.OnReject.ServeHTTP(w, r.WithContext(withQueue(r.Context(), queue, rate.InfDuration)))
+		return
+	}
+
+	if code == CodeInvalidCount {
+		writeError(w, r, http.StatusBadRequest, code, "Bad Request: request uses up more slots than any queue holds", 0)
+		return
+	}
+	writeError(w, r, blitz.reject, code, "∞ delay", retry)
+}
+
+// serveHoldExceeded rejects a request whose delay exceeds the maximum duration requests are held for.
+// The client is told to retry once the delay would be short enough.
+func (blitz *Blitz) serveHoldExceeded(w http.ResponseWriter, r *http.Request, queue int, delay time.Duration) {
+	blitz.logEvent(event{Name: eventReject, Client: blitz.clientAddr(r), Queue: queue, Delay: delay})
+	blitz.counters[queue].rejected.Add(1)
+	traceRejection(r)
+	blitz.rejected(CodeDelayTooLong, r)
+
+	// only observing => forward anyways
+	if blitz.observeOnly {
+		blitz.forward(w, r, queue, 0)
+		return
+	}
+
+	retry := delay - blitz.maxHold
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retry.Seconds())), 10))
+	writeError(w, r, http.StatusTooManyRequests, CodeDelayTooLong, "Too Many Requests: delay exceeds the maximum hold", retry)
+}
+
+// retryAfter returns how long a client should wait before retrying a request on the given queue.
+// It is the time it takes for a single slot to refill.
+// If the queue can never admit a request, returns false.
+func (blitz *Blitz) retryAfter(queue int) (time.Duration, bool) {
+	if queue < 0 || queue >= len(blitz.limiters) {
+		return 0, false
+	}
+	limiter := blitz.limiters[queue]
+	if limiter.Burst() == 0 || limiter.Limit() <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(time.Second) / float64(limiter.Limit())), true
+}
+
+// lockedReader serializes reads from a reader that may not be safe for concurrent use.
+type lockedReader struct {
+	m sync.Mutex
+	r io.Reader
+}
+
+func (lr *lockedReader) Read(p []byte) (int, error) {
+	lr.m.Lock()
+	defer lr.m.Unlock()
+
+	return lr.r.Read(p)
 }
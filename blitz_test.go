@@ -0,0 +1,442 @@
+package blitz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// okHandler responds to every request with "ok".
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+})
+
+// newTestBlitz creates a new server wrapping okHandler, configured using the given options.
+// It discards its logs, unless the options set a logger.
+func newTestBlitz(t testing.TB, opts ...Option) *Blitz {
+	t.Helper()
+
+	opts = append([]Option{WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	blitz, err := NewWithOptions(okHandler, opts...)
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	return blitz
+}
+
+// sendRequest sends a request without a reservation to blitz, passing the given headers.
+// It returns the response, along with the error body if there is one.
+func sendRequest(t testing.TB, blitz *Blitz, headers map[string]string) (*httptest.ResponseRecorder, ErrorBody) {
+	t.Helper()
+	return sendRequestContext(t, blitz, context.Background(), headers)
+}
+
+// sendRequestContext is like sendRequest, but sends the request with the given context.
+func sendRequestContext(t testing.TB, blitz *Blitz, ctx context.Context, headers map[string]string) (*httptest.ResponseRecorder, ErrorBody) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	r.Header.Set("Accept", "application/json")
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	blitz.ServeHTTP(w, r)
+
+	var body ErrorBody
+	if w.Code != http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding error body %q: %v", w.Body.String(), err)
+		}
+	}
+	return w, body
+}
+
+func TestServeRegularReject(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		requests []map[string]string // requests sent, the last one of which is checked
+
+		wantStatus int
+		wantCode   string
+		wantRetry  bool
+	}{
+		{
+			name:       "queue too large",
+			opts:       []Option{WithQueues([]uint64{1, 1})},
+			requests:   []map[string]string{{HeaderQueue: "2"}},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CodeInvalidQueue,
+		},
+		{
+			name:       "queue negative",
+			opts:       []Option{WithQueues([]uint64{1, 1})},
+			requests:   []map[string]string{{HeaderQueue: "-1"}},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CodeInvalidQueue,
+		},
+		{
+			name:       "queue exhausted",
+			opts:       []Option{WithQueues([]uint64{1, 1}), WithMaxHold(100 * time.Millisecond)},
+			requests:   []map[string]string{{HeaderQueue: "1"}, {HeaderQueue: "1"}, {HeaderQueue: "1"}},
+			wantStatus: http.StatusTooManyRequests,
+			wantCode:   CodeDelayTooLong,
+			wantRetry:  true,
+		},
+		{
+			name:       "queue closed",
+			opts:       []Option{WithQueues([]uint64{0})},
+			requests:   []map[string]string{{HeaderQueue: "0"}},
+			wantStatus: http.StatusTooManyRequests,
+			wantCode:   CodeQueueFull,
+		},
+		{
+			name:       "too large for any queue",
+			opts:       []Option{WithQueues([]uint64{2, 1}), WithCostFunc(func(r *http.Request) int { return 3 })},
+			requests:   []map[string]string{{HeaderQueue: "1"}},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CodeInvalidCount,
+		},
+		{
+			name:       "too large for weighted lenders",
+			opts:       []Option{WithQueueConfigs([]QueueConfig{{Rate: 5}, {Rate: 1, Weight: 1}, {Rate: 1}}), WithCostFunc(func(r *http.Request) int { return 3 })},
+			requests:   []map[string]string{{HeaderQueue: "2"}},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CodeInvalidCount,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blitz := newTestBlitz(t, append(tt.opts, WithClock(newFakeClock()))...)
+
+			var (
+				w    *httptest.ResponseRecorder
+				body ErrorBody
+			)
+			for _, headers := range tt.requests {
+				w, body = sendRequest(t, blitz, headers)
+			}
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if body.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tt.wantCode)
+			}
+			if retry := w.Header().Get("Retry-After") != ""; retry != tt.wantRetry {
+				t.Errorf("Retry-After present = %t, want %t", retry, tt.wantRetry)
+			}
+		})
+	}
+}
+
+// doneContext returns a context that is done, either cancelled or with its deadline passed.
+func doneContext(deadline bool) context.Context {
+	if deadline {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Unix(0, 0))
+		cancel()
+		return ctx
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestServeRegularCancelled(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		deadline bool
+
+		wantStatus int
+		wantCode   string
+	}{
+		{"cancelled", nil, false, DefaultCancelStatus, CodeCancelled},
+		{"custom status", []Option{WithCancelStatus(http.StatusRequestTimeout)}, false, http.StatusRequestTimeout, CodeCancelled},
+		{"deadline passed", nil, true, http.StatusRequestTimeout, CodeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blitz := newTestBlitz(t, append(tt.opts, WithClock(newFakeClock()), WithQueues([]uint64{1}), WithRefill(time.Second))...)
+
+			// use up the only slot, so that the request has to wait
+			if !blitz.Allow(0) {
+				t.Fatal("Allow() = false, want true")
+			}
+
+			w, body := sendRequestContext(t, blitz, doneContext(tt.deadline), nil)
+			if w.Code != tt.wantStatus || body.Code != tt.wantCode {
+				t.Errorf("response = %d %q, want %d %q", w.Code, body.Code, tt.wantStatus, tt.wantCode)
+			}
+			if w.Code == http.StatusBadGateway {
+				t.Error("cancelled request reported as a gateway error")
+			}
+		})
+	}
+}
+
+func TestRefillInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		every time.Duration
+
+		wantErr error
+	}{
+		{"positive", time.Millisecond, nil},
+		{"zero", 0, errInvalidRefill},
+		{"negative", -time.Second, errInvalidRefill},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewWithOptions(okHandler, WithRefill(tt.every))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewWithOptions() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRefillWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		queue QueueConfig
+
+		window time.Duration
+		want   int // requests admitted over the window, after using up the initial burst
+	}{
+		{"per second", nil, QueueConfig{Rate: 10}, 10 * time.Second, 100},
+		{"per minute", []Option{WithRefill(time.Minute)}, QueueConfig{Rate: 100}, time.Minute, 100},
+		{"per minute over an hour", []Option{WithRefill(time.Minute)}, QueueConfig{Rate: 100}, time.Hour, 6000},
+		{"own refill", nil, QueueConfig{Rate: 5, Every: 500 * time.Millisecond}, 10 * time.Second, 100},
+		{"burst", nil, QueueConfig{Rate: 10, Burst: 50}, 10 * time.Second, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			blitz := newTestBlitz(t, append(tt.opts, WithClock(clock), WithQueueConfigs([]QueueConfig{tt.queue}))...)
+
+			for blitz.Allow(0) {
+			}
+
+			// poll more often than slots refill, so none are lost to the burst
+			admitted := 0
+			const step = 10 * time.Millisecond
+			for elapsed := time.Duration(0); elapsed < tt.window; elapsed += step {
+				clock.Advance(step)
+				for blitz.Allow(0) {
+					admitted++
+				}
+			}
+			if admitted != tt.want {
+				t.Errorf("admitted %d requests over %s, want %d", admitted, tt.window, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxHold(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxHold time.Duration
+
+		wantStatus  int
+		wantRetryMs int64
+	}{
+		{"delay exceeds", 40 * time.Millisecond, http.StatusTooManyRequests, 60},
+		{"delay barely exceeds", 99 * time.Millisecond, http.StatusTooManyRequests, 1},
+		{"delay equals", 100 * time.Millisecond, http.StatusOK, 0},
+		{"unlimited", 0, http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			blitz := newTestBlitz(t, WithClock(clock), WithQueues([]uint64{10}), WithRefill(time.Second), WithMaxHold(tt.maxHold))
+
+			// use up the burst, so that the next request has a delay of 100ms
+			for blitz.Allow(0) {
+			}
+
+			done := make(chan *httptest.ResponseRecorder, 1)
+			var body ErrorBody
+			go func() {
+				var w *httptest.ResponseRecorder
+				w, body = sendRequest(t, blitz, nil)
+				done <- w
+			}()
+
+			// held requests are released once the delay passed
+			if tt.wantStatus == http.StatusOK {
+				for clock.Pending() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				clock.Advance(100 * time.Millisecond)
+			}
+			w := <-done
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusTooManyRequests {
+				return
+			}
+			if body.Code != CodeDelayTooLong || body.RetryAfterMs != tt.wantRetryMs {
+				t.Errorf("body = %q retry %dms, want %q retry %dms", body.Code, body.RetryAfterMs, CodeDelayTooLong, tt.wantRetryMs)
+			}
+			if retry := w.Header().Get("Retry-After"); retry != "1" {
+				t.Errorf("Retry-After = %q, want %q", retry, "1")
+			}
+		})
+	}
+}
+
+func TestQueueBurst(t *testing.T) {
+	clock := newFakeClock()
+	blitz := newTestBlitz(t, WithClock(clock), WithQueueConfigs([]QueueConfig{{Rate: 10, Burst: 50}}), WithRefill(time.Second))
+
+	// a full queue admits the whole burst at once
+	admitted := 0
+	for blitz.Allow(0) {
+		admitted++
+	}
+	if admitted != 50 {
+		t.Errorf("admitted %d requests at once, want 50", admitted)
+	}
+
+	// and afterwards refills at the rate
+	clock.Advance(time.Second)
+	admitted = 0
+	for blitz.Allow(0) {
+		admitted++
+	}
+	if admitted != 10 {
+		t.Errorf("admitted %d requests after a second, want 10", admitted)
+	}
+
+	// once idle, the whole burst can be reserved at once
+	clock.Advance(5 * time.Second)
+	status, rs := requestReservation(t, blitz, map[string]string{HeaderCount: "50"})
+	if status != http.StatusOK || !rs.Success || rs.DelayInMilliseconds != 0 {
+		t.Errorf("reservation for 50 = %d %q delay %dms, want an immediate reservation", status, rs.Code, rs.DelayInMilliseconds)
+	}
+}
+
+func TestControlMethods(t *testing.T) {
+	const (
+		all       = "GET, HEAD, POST, OPTIONS"
+		allConfig = "GET, HEAD, POST, DELETE, OPTIONS" // with ConfigAuth set
+	)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		config bool // set ConfigAuth
+
+		wantStatus int
+		wantAllow  string // Allow header of the response, if any
+		wantBody   bool
+	}{
+		{"status get", http.MethodGet, "", false, http.StatusOK, "", true},
+		{"status head", http.MethodHead, "", false, http.StatusOK, "", false},
+		{"status options", http.MethodOptions, "", false, http.StatusNoContent, all, false},
+		{"status put", http.MethodPut, "", false, http.StatusMethodNotAllowed, "", true},
+		{"status delete", http.MethodDelete, "", false, http.StatusNotFound, "", true},
+		{"status options with config", http.MethodOptions, "", true, http.StatusNoContent, allConfig, false},
+		{"status delete with config", http.MethodDelete, "", true, http.StatusOK, "", true},
+		{"health head", http.MethodHead, healthPath, false, http.StatusOK, "", false},
+		{"health options", http.MethodOptions, healthPath, false, http.StatusNoContent, "GET, HEAD, OPTIONS", false},
+		{"health post", http.MethodPost, healthPath, false, http.StatusMethodNotAllowed, "", true},
+		{"pubkey head", http.MethodHead, publicKeyPath, false, http.StatusOK, "", false},
+		{"pubkey options", http.MethodOptions, publicKeyPath, false, http.StatusNoContent, "GET, HEAD, OPTIONS", false},
+		{"pubkey patch", http.MethodPatch, publicKeyPath, false, http.StatusMethodNotAllowed, "", true},
+		{"config options", http.MethodOptions, configPath, false, http.StatusNoContent, "POST, OPTIONS", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// use a real server, which drops the body of responses to HEAD requests
+			blitz := newTestBlitz(t)
+			if tt.config {
+				blitz.ConfigAuth = func(r *http.Request) bool { return true }
+			}
+			server := httptest.NewServer(blitz)
+			defer server.Close()
+
+			r, err := http.NewRequest(tt.method, server.URL+DefaultControlPath+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+			if tt.wantAllow != "" {
+				if allow := res.Header.Get("Allow"); allow != tt.wantAllow {
+					t.Errorf("Allow = %q, want %q", allow, tt.wantAllow)
+				}
+			}
+			if hasBody := len(body) > 0; hasBody != tt.wantBody {
+				t.Errorf("body = %q, want a body: %t", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestControlPreflight(t *testing.T) {
+	blitz := newTestBlitz(t, WithCORS([]string{"https://example.com"}))
+	blitz.ConfigAuth = func(r *http.Request) bool { return true }
+
+	r := httptest.NewRequest(http.MethodOptions, DefaultControlPath, nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w := httptest.NewRecorder()
+	blitz.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://example.com",
+		"Access-Control-Allow-Methods": "GET, HEAD, POST, DELETE, OPTIONS",
+		"Access-Control-Allow-Headers": corsHeaders,
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+// BenchmarkServeRegular measures requests admitted without a delay, which are forwarded without waiting.
+func BenchmarkServeRegular(b *testing.B) {
+	blitz := newTestBlitz(b, WithQueues([]uint64{1 << 40}))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			blitz.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				b.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package blitz
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientAddr returns the address of the client making the request, normalized using [normalizeAddr].
+// It is used to identify clients for logging and per-client limits.
+//
+// If the request comes from a trusted proxy, the address is taken from the X-Forwarded-For header instead.
+// Unless configured otherwise, it is the rightmost entry that is not a trusted proxy itself.
+func (blitz *Blitz) clientAddr(r *http.Request) string {
+	client, _ := blitz.clientChain(r)
+	return client
+}
+
+// clientChain is like clientAddr, but additionally returns the trusted part of the X-Forwarded-For header.
+// It starts at the entry identifying the client, and is empty unless the header is trusted.
+func (blitz *Blitz) clientChain(r *http.Request) (string, []string) {
+	remote := clientKey(r)
+	if !blitz.trustProxy && !blitz.isTrustedProxy(remote) {
+		return remote, nil
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop := strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, normalizeAddr(hop))
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return remote, nil
+	}
+
+	if blitz.forwardedFirst {
+		return hops[0], hops
+	}
+	for i := len(hops) - 1; i > 0; i-- {
+		if !blitz.isTrustedProxy(hops[i]) {
+			return hops[i], hops[i:]
+		}
+	}
+	return hops[0], hops
+}
+
+// HeaderRealIP is the header telling the handler about the address of the client, see [WithForwardClientHeaders].
+const HeaderRealIP = "X-Real-IP"
+
+// setClientHeaders replaces the X-Forwarded-For and [HeaderRealIP] headers of the given request, see [WithForwardClientHeaders].
+func (blitz *Blitz) setClientHeaders(r *http.Request) {
+	client, chain := blitz.clientChain(r)
+
+	r.Header.Del("X-Forwarded-For")
+	if len(chain) > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	}
+	r.Header.Set(HeaderRealIP, client)
+}
+
+// clientKey returns the key of the peer that sent the request, that is its remote address normalized using [normalizeAddr].
+// Unlike [Blitz.clientAddr], it ignores any X-Forwarded-For header.
+func clientKey(r *http.Request) string {
+	return normalizeAddr(r.RemoteAddr)
+}
+
+// normalizeAddr normalizes the given address of a client, so that each client has exactly one key.
+// It strips the port, if any, and formats ip addresses canonically, treating IPv4-mapped IPv6 addresses as IPv4.
+// For example, "[::ffff:1.2.3.4]:5678" becomes "1.2.3.4", and "[2001:DB8::0:1]" becomes "2001:db8::1".
+//
+// Addresses that are not ip addresses, such as the name of a unix socket, are only stripped of their port.
+func normalizeAddr(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	} else if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1]
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return addr
+	}
+	return ip.Unmap().String()
+}
+
+// isTrustedProxy checks if the given address belongs to a proxy trusted using [WithTrustedProxies].
+func (blitz *Blitz) isTrustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range blitz.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientLimiters limits the rate of each client individually.
+type clientLimiters struct {
+	every time.Duration // how often the limiter of each client refills
+	burst int           // burst of each client
+	ttl   time.Duration // duration after which idle clients are forgotten
+
+	m         sync.Mutex
+	lastEvict time.Time
+	clients   map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiters(every time.Duration, burst int, ttl time.Duration) *clientLimiters {
+	return &clientLimiters{
+		every: every,
+		burst: burst,
+		ttl:   ttl,
+
+		clients: make(map[string]*clientLimiter),
+	}
+}
+
+// reserve reserves a slot for the given client at the given time.
+func (cl *clientLimiters) reserve(client string, now time.Time) *rate.Reservation {
+	cl.m.Lock()
+	defer cl.m.Unlock()
+
+	// forget idle clients every once in a while
+	if now.Sub(cl.lastEvict) > cl.ttl {
+		cl.evict(now)
+	}
+
+	c, ok := cl.clients[client]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rate.Every(cl.every), cl.burst)}
+		cl.clients[client] = c
+	}
+	c.lastSeen = now
+
+	return c.limiter.ReserveN(now, 1)
+}
+
+// evict forgets all clients that have been idle for longer than the ttl.
+func (cl *clientLimiters) evict(now time.Time) {
+	cl.lastEvict = now
+	for client, c := range cl.clients {
+		if now.Sub(c.lastSeen) > cl.ttl {
+			delete(cl.clients, client)
+		}
+	}
+}
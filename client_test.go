@@ -0,0 +1,76 @@
+package blitz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+
+		want string
+	}{
+		{"ipv4", "1.2.3.4:5678", "1.2.3.4"},
+		{"ipv4 without port", "1.2.3.4", "1.2.3.4"},
+		{"ipv6", "[2001:db8::1]:5678", "2001:db8::1"},
+		{"ipv6 without port", "[2001:db8::1]", "2001:db8::1"},
+		{"ipv6 unbracketed", "2001:db8::1", "2001:db8::1"},
+		{"ipv6 not canonical", "[2001:DB8:0:0::0:1]:5678", "2001:db8::1"},
+		{"ipv6 loopback", "[::1]:5678", "::1"},
+		{"ipv4-mapped ipv6", "[::ffff:1.2.3.4]:5678", "1.2.3.4"},
+		{"ipv6 zone", "[fe80::1%eth0]:5678", "fe80::1%eth0"},
+		{"unix socket", "@", "@"},
+		{"empty", "", ""},
+		{"host name", "example.com:80", "example.com"},
+		{"malformed port", "1.2.3.4:", "1.2.3.4"},
+		{"malformed brackets", "[1.2.3.4", "[1.2.3.4"},
+		{"garbage", "not an address", "not an address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if got := clientKey(r); got != tt.want {
+				t.Errorf("clientKey(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientAddrForwarded(t *testing.T) {
+	blitz := newTestBlitz(t, WithTrustedProxies([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:5678"
+	r.Header.Set("X-Forwarded-For", "[::ffff:1.2.3.4]:1234, 10.0.0.2")
+
+	if got := blitz.clientAddr(r); got != "1.2.3.4" {
+		t.Errorf("clientAddr() = %q, want %q", got, "1.2.3.4")
+	}
+	if got := clientKey(r); got != "10.0.0.1" {
+		t.Errorf("clientKey() = %q, want %q", got, "10.0.0.1")
+	}
+}
+
+func TestPerClientLimitClock(t *testing.T) {
+	clock := newFakeClock()
+	blitz := newTestBlitz(t, WithClock(clock), WithQueues([]uint64{10}), WithRefill(time.Second), WithPerClientLimit(time.Hour, 1, 0))
+
+	if _, rs := requestReservation(t, blitz, nil); !rs.Success || rs.DelayInMilliseconds != 0 {
+		t.Fatalf("first reservation = %q with delay %dms, want an immediate reservation", rs.Code, rs.DelayInMilliseconds)
+	}
+	if _, rs := requestReservation(t, blitz, nil); rs.Success && rs.DelayInMilliseconds == 0 {
+		t.Errorf("second reservation = immediate, want it delayed by the client limit")
+	}
+
+	// the limiter of the client refills using the clock of the server
+	clock.Advance(2 * time.Hour)
+	if _, rs := requestReservation(t, blitz, nil); !rs.Success || rs.DelayInMilliseconds != 0 {
+		t.Errorf("reservation after refill = %q with delay %dms, want an immediate reservation", rs.Code, rs.DelayInMilliseconds)
+	}
+}
@@ -0,0 +1,72 @@
+package blitz
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of time.
+// It allows tests to control the passing of time, see [WithClock].
+//
+// Implementations must be safe for concurrent use.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer waits for the duration to elapse and then sends the current time on the returned channel.
+	// Calling the returned stop function releases the timer, and reports whether doing so prevented it from firing, like [time.Timer.Stop].
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+// realClock is a [Clock] that uses the system time.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// monotoneClock wraps a [Clock] that may step backward, such as one not carrying monotonic clock readings.
+// It never returns a time before one it returned previously: while the wrapped clock is behind, it holds the latest time.
+type monotoneClock struct {
+	Clock
+
+	// onStep, if non-nil, is called with the size of the step whenever the wrapped clock starts being behind
+	onStep func(step time.Duration)
+
+	m      sync.Mutex
+	last   time.Time // latest time returned
+	behind bool      // the wrapped clock is behind last
+}
+
+// newMonotoneClock wraps clock unless it is guaranteed to be monotone already.
+// The system time is, as comparing and subtracting times returned by [time.Now] uses the monotonic clock.
+func newMonotoneClock(clock Clock, onStep func(step time.Duration)) Clock {
+	if _, ok := clock.(realClock); ok {
+		return clock
+	}
+	return &monotoneClock{Clock: clock, onStep: onStep}
+}
+
+func (c *monotoneClock) Now() time.Time {
+	now := c.Clock.Now()
+
+	c.m.Lock()
+	if !now.Before(c.last) {
+		c.last, c.behind = now, false
+		c.m.Unlock()
+		return now
+	}
+
+	// the clock stepped backward => report it once and hold the latest time
+	last, reported := c.last, c.behind
+	c.behind = true
+	c.m.Unlock()
+
+	if !reported && c.onStep != nil {
+		c.onStep(last.Sub(now))
+	}
+	return last
+}
@@ -0,0 +1,115 @@
+package blitz
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a [Clock] whose time only changes when told to.
+type fakeClock struct {
+	m      sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a timer created by a [fakeClock].
+type fakeTimer struct {
+	at      time.Time
+	c       chan time.Time
+	stopped bool
+	fired   bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	timer := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	c.fire()
+
+	return timer.c, func() bool {
+		c.m.Lock()
+		defer c.m.Unlock()
+
+		stopped := !timer.fired && !timer.stopped
+		timer.stopped = true
+		return stopped
+	}
+}
+
+// Advance moves the clock forward by d, firing all timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set sets the time of the clock, which may be before the current one.
+func (c *fakeClock) Set(now time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.now = now
+	c.fire()
+}
+
+// Pending returns the number of timers that neither fired nor were stopped.
+func (c *fakeClock) Pending() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	pending := 0
+	for _, timer := range c.timers {
+		if !timer.fired && !timer.stopped {
+			pending++
+		}
+	}
+	return pending
+}
+
+// fire fires all timers that are due.
+// The mutex must be held.
+func (c *fakeClock) fire() {
+	for _, timer := range c.timers {
+		if !timer.fired && !timer.stopped && !c.now.Before(timer.at) {
+			timer.fired = true
+			timer.c <- c.now
+		}
+	}
+}
+
+func TestMonotoneClock(t *testing.T) {
+	fake := newFakeClock()
+	var steps []time.Duration
+	clock := newMonotoneClock(fake, func(step time.Duration) { steps = append(steps, step) })
+
+	start := clock.Now()
+	fake.Set(start.Add(-time.Minute))
+	if now := clock.Now(); !now.Equal(start) {
+		t.Errorf("Now() after step = %v, want %v", now, start)
+	}
+	if now := clock.Now(); !now.Equal(start) {
+		t.Errorf("Now() while behind = %v, want %v", now, start)
+	}
+
+	fake.Set(start.Add(time.Second))
+	if now := clock.Now(); !now.Equal(start.Add(time.Second)) {
+		t.Errorf("Now() after catching up = %v, want %v", now, start.Add(time.Second))
+	}
+
+	// the step is reported once, however long the clock is behind
+	if len(steps) != 1 || steps[0] != time.Minute {
+		t.Errorf("reported steps = %v, want [%v]", steps, time.Minute)
+	}
+}
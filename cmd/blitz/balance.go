@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+)
+
+// strategies to pick a backend with
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+)
+
+// backend is a single target to proxy to
+type backend struct {
+	director func(*http.Request) // rewrites requests to this backend
+	active   atomic.Int64        // number of requests currently being proxied
+}
+
+// balancer proxies requests to a pool of backends
+type balancer struct {
+	backends  []*backend
+	leastConn bool          // pick the backend with the fewest active requests, rather than round-robin
+	next      atomic.Uint64 // index of the next backend in round-robin mode
+
+	proxy *httputil.ReverseProxy
+}
+
+type backendKey struct{}
+
+// newBalancer creates a new balancer for the given targets, using the given strategy.
+func newBalancer(targets []string, strategy string) (*balancer, error) {
+	if strategy != balanceRoundRobin && strategy != balanceLeastConn {
+		return nil, fmt.Errorf("unknown balancing strategy %q", strategy)
+	}
+
+	b := &balancer{
+		backends:  make([]*backend, len(targets)),
+		leastConn: strategy == balanceLeastConn,
+	}
+	for i, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		b.backends[i] = &backend{director: httputil.NewSingleHostReverseProxy(u).Director}
+	}
+
+	b.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.Context().Value(backendKey{}).(*backend).director(r)
+		},
+	}
+	return b, nil
+}
+
+// pick picks the backend to proxy the next request to
+func (b *balancer) pick() *backend {
+	if !b.leastConn {
+		return b.backends[(b.next.Add(1)-1)%uint64(len(b.backends))]
+	}
+
+	// find the backend with the fewest active requests, starting at a rotating offset to break ties fairly
+	offset := int(b.next.Add(1) % uint64(len(b.backends)))
+	best := b.backends[offset]
+	for i := 1; i < len(b.backends); i++ {
+		candidate := b.backends[(offset+i)%len(b.backends)]
+		if candidate.active.Load() < best.active.Load() {
+			best = candidate
+		}
+	}
+	return best
+}
+
+func (b *balancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	backend := b.pick()
+
+	backend.active.Add(1)
+	defer backend.active.Add(-1)
+
+	b.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), backendKey{}, backend)))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fau-cdi/blitz"
+)
+
+// config is the content of a configuration file.
+// Every field is optional, and overridden by the corresponding command line flags.
+type config struct {
+	Bind    string   // address to bind to, see -bind
+	Targets []string // targets to proxy to, see -target
+	Balance string   // strategy to balance between targets, see -balance
+
+	Every  duration      // default refill duration of queues
+	Queues []queueConfig // configuration of each queue, see -queue and -every
+
+	TLS struct {
+		Cert     string // see -tls-cert
+		Key      string // see -tls-key
+		Redirect bool   // see -tls-redirect
+	}
+}
+
+// queueConfig is the configuration of a single queue in a configuration file
+type queueConfig struct {
+	Name           string
+	Rate           uint64
+	Burst          uint64
+	Every          duration
+	Weight         uint64
+	MaxConcurrent  uint64
+	MaxQueueLength uint64
+}
+
+// duration is a [time.Duration] that is encoded as a string such as "1.5s" in json
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("duration must be a string such as \"1s\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// refill is the default refill duration of queues
+var refill time.Duration = time.Second
+
+// fileQueues are the queues loaded from the configuration file, used unless the -queue flag is given
+var fileQueues []blitz.QueueConfig
+
+// loadConfig reads the json configuration file at path, rejecting unknown fields.
+// Other formats are not supported, files ending in ".yaml" or ".yml" are rejected explicitly.
+func loadConfig(path string) (c config, err error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return c, fmt.Errorf("config file %q: yaml is not supported, the configuration must be json", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return c, fmt.Errorf("config file %q: %w", path, err)
+	}
+	if decoder.More() {
+		return c, fmt.Errorf("config file %q: unexpected data after configuration", path)
+	}
+
+	if c.Every < 0 {
+		return c, fmt.Errorf("config file %q: Every must not be negative", path)
+	}
+	for i, q := range c.Queues {
+		if q.Every < 0 {
+			return c, fmt.Errorf("config file %q: Every of queue %d must not be negative", path, i)
+		}
+	}
+	return c, nil
+}
+
+// apply applies this configuration to all values that were not given as flags.
+func (c config) apply() {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if c.Bind != "" && !set["bind"] {
+		bindAddress = c.Bind
+	}
+	if len(c.Targets) != 0 && !set["target"] {
+		redirectTargets = c.Targets
+	}
+	if c.Balance != "" && !set["balance"] {
+		balance = c.Balance
+	}
+
+	if c.Every != 0 {
+		refill = time.Duration(c.Every)
+	}
+	fileQueues = make([]blitz.QueueConfig, len(c.Queues))
+	for i, q := range c.Queues {
+		fileQueues[i] = blitz.QueueConfig{Name: q.Name, Rate: q.Rate, Burst: q.Burst, Every: time.Duration(q.Every), Weight: q.Weight, MaxConcurrent: q.MaxConcurrent, MaxQueueLength: q.MaxQueueLength}
+	}
+
+	if c.TLS.Cert != "" && !set["tls-cert"] {
+		tlsCert = c.TLS.Cert
+	}
+	if c.TLS.Key != "" && !set["tls-key"] {
+		tlsKey = c.TLS.Key
+	}
+	if c.TLS.Redirect && !set["tls-redirect"] {
+		tlsRedirect = true
+	}
+}
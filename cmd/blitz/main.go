@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
+	"io/fs"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/netip"
 	"net/url"
-	"time"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/fau-cdi/blitz"
 )
@@ -14,19 +24,259 @@ import (
 //go:generate gogenlicense -m
 
 func main() {
-	u, err := url.Parse(redirectTarget)
+	// create a proxy and a wrapper around it
+	proxy, err := newBalancer(redirectTargets, balance)
 	if err != nil {
 		panic(err)
 	}
+	configs := queueConfigs()
+	rates := make([]uint64, len(configs))
+	for i, q := range configs {
+		rates[i] = q.Rate
+	}
 
-	// create a proxy and a wrapper around it
-	proxy := httputil.NewSingleHostReverseProxy(u)
-	handler, err := blitz.New(rand.Reader, proxy, time.Second, qrates)
+	opts := []blitz.Option{
+		blitz.WithRand(rand.Reader),
+		blitz.WithRefill(refill),
+		blitz.WithQueueConfigs(configs),
+		blitz.WithControlPath(controlPath),
+		blitz.WithMaxReservationDelay(maxReservationDelay),
+		blitz.WithReservationTTL(reservationTTL),
+		blitz.WithReservationConfirm(reservationConfirm),
+		blitz.WithMaxPendingConfirmations(maxPending),
+		blitz.WithMaxWaiters(maxWaiters),
+		blitz.WithMaxHold(maxHold),
+		blitz.WithJitter(jitter),
+		blitz.WithStatsWindow(statsWindow),
+		blitz.WithObserveOnly(observeOnly),
+		blitz.WithUpgradeQueue(upgradeQueue),
+		blitz.WithUpgradeBypass(upgradeBypass),
+		blitz.WithSeparateControl(controlAddress != ""),
+		blitz.WithLogLevel(logLevel),
+	}
+	if keyFile != "" {
+		opts = append(opts, blitz.WithKeyFile(keyFile))
+	}
+	if hmacKeyFile != "" {
+		key, err := os.ReadFile(hmacKeyFile)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, blitz.WithHMACKey(bytes.TrimSpace(key)))
+	}
+	for _, path := range verifyKeyFiles {
+		opts = append(opts, blitz.WithVerifyKeyFile(path))
+	}
+	if globalRate > 0 {
+		burst := globalBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(globalRate))
+		}
+		opts = append(opts, blitz.WithGlobalRate(globalRate, burst))
+	}
+	if reserveRate > 0 {
+		burst := reserveBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(reserveRate))
+		}
+		opts = append(opts, blitz.WithReservationRate(reserveRate, burst))
+	}
+	if verifyCache > 0 {
+		opts = append(opts, blitz.WithVerifyCache(verifyCache))
+	}
+	if clientBurst > 0 {
+		opts = append(opts, blitz.WithPerClientLimit(clientEvery, clientBurst, 0))
+	}
+	if trustProxy {
+		opts = append(opts, blitz.WithTrustProxy(true))
+	}
+	if len(corsOrigins) > 0 {
+		opts = append(opts, blitz.WithCORS(corsOrigins))
+	}
+	if len(trustedProxies) > 0 {
+		prefixes := make([]netip.Prefix, len(trustedProxies))
+		for i, proxy := range trustedProxies {
+			prefixes[i], err = netip.ParsePrefix(proxy)
+			if err != nil {
+				panic(err)
+			}
+		}
+		opts = append(opts, blitz.WithTrustedProxies(prefixes))
+	}
+	if forwardedFirst {
+		opts = append(opts, blitz.WithForwardedFirst(true))
+	}
+	if reservationQuery != "" {
+		opts = append(opts, blitz.WithReservationQuery(reservationQuery))
+	}
+	if reservationCookie != "" {
+		opts = append(opts, blitz.WithReservationCookie(reservationCookie))
+	}
+	if forwardHeaders {
+		opts = append(opts, blitz.WithForwardHeaders(true))
+	}
+	if forwardQueue {
+		opts = append(opts, blitz.WithForwardQueueHeader(true))
+	}
+	if forwardClient {
+		opts = append(opts, blitz.WithForwardClientHeaders(true))
+	}
+	if borrowDepth > 0 {
+		opts = append(opts, blitz.WithBorrowDepth(borrowDepth))
+	}
+	if randomDowngrade {
+		opts = append(opts, blitz.WithRandomDowngrade(true))
+	}
+	if strictQueue {
+		opts = append(opts, blitz.WithStrictQueueHeader(true))
+	}
+	if forwardExpires {
+		opts = append(opts, blitz.WithForwardExpiresHeader(true))
+	}
+	if logJSON {
+		opts = append(opts, blitz.WithSlogLogger(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))))
+	}
+	if failOpen {
+		opts = append(opts, blitz.WithFailMode(blitz.FailOpen))
+	}
+	if singleUse {
+		opts = append(opts, blitz.WithNonceStore(new(blitz.MemoryNonceStore)))
+	}
+	if bindRequest {
+		opts = append(opts, blitz.WithBindRequest(true))
+	}
+	if perQueueKeys {
+		opts = append(opts, blitz.WithPerQueueKeys(true))
+	}
+	handler, err := blitz.NewWithOptions(proxy, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	// servers on other addresses, shut down along with the main server
+	var servers []*http.Server
+
+	// serve metrics on a separate address
+	if metricsAddress != "" {
+		log.Printf("Serving metrics on %s", metricsAddress)
+		servers = append(servers, serve(metricsAddress, handler.MetricsHandler()))
+	}
+
+	// serve the control endpoint on a separate address
+	if controlAddress != "" {
+		log.Printf("Serving %s on %s", controlPath, controlAddress)
+		servers = append(servers, serve(controlAddress, handler.ControlHandler()))
+	}
+
+	// redirect plain http to https
+	if tlsRedirect {
+		log.Printf("Redirecting %s to https", redirectAddress)
+		servers = append(servers, serve(redirectAddress, http.HandlerFunc(redirectHTTPS)))
+	}
+
+	if observeOnly {
+		log.Printf("Observe only: requests are forwarded immediately, delays are only recorded")
+	}
+
+	// start the server
+	listener, err := listen(bindAddress)
+	if err != nil {
+		panic(err)
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		var err error
+		if tlsCert == "" {
+			log.Printf("Proxying %s to %s at rates of %v / second \n", bindAddress, redirectTargets.String(), rates)
+			err = server.Serve(listener)
+		} else {
+			log.Printf("Proxying %s (https) to %s at rates of %v / second \n", bindAddress, redirectTargets.String(), rates)
+			err = server.ServeTLS(listener, tlsCert, tlsKey)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// wait for a signal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	// and shut down gracefully
+	log.Printf("Shutting down, waiting up to %s for requests to complete", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	go handler.Shutdown(ctx)
+	err = server.Shutdown(ctx)
+	for _, s := range servers {
+		if sErr := s.Shutdown(ctx); err == nil {
+			err = sErr
+		}
+	}
+	if err != nil {
+		log.Printf("Shutdown timed out, closing remaining connections: %v", err)
+		handler.Close()
+		server.Close()
+		for _, s := range servers {
+			s.Close()
+		}
+		return
+	}
+	log.Printf("Shutdown complete")
+}
+
+// serve listens on the given address, and serves handler on it in a new goroutine.
+// Like for the main server, failing to listen or serve panics.
+func serve(address string, handler http.Handler) *http.Server {
+	listener, err := listen(address)
 	if err != nil {
 		panic(err)
 	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+	return server
+}
+
+// unixPrefix is the prefix of addresses of unix domain sockets, such as "unix:/run/blitz.sock"
+const unixPrefix = "unix:"
+
+// listen listens on the given address.
+// Addresses starting with unixPrefix listen on a unix domain socket, which is removed once the listener is closed.
+// Other addresses listen on tcp.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	// remove a socket left behind by a previous run that did not shut down cleanly
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// redirectAddress is the address to redirect plain http requests to https on
+const redirectAddress = ":80"
+
+// redirectHTTPS redirects a request to the https server
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(bindAddress); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
 
-	// and start an http server
-	log.Printf("Proxying %s to %s at rates of %v / second \n", bindAddress, redirectTarget, qrates)
-	http.ListenAndServe(bindAddress, handler)
+	target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
 }
@@ -3,21 +3,125 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/fau-cdi/blitz"
 )
 
 var qrates queues
-var redirectTarget string
+var qevery durations
+var redirectTargets strs
+var balance string = balanceRoundRobin
 var bindAddress string = "127.0.0.1:8080"
+var controlPath string = blitz.DefaultControlPath
+var metricsAddress string
+var controlAddress string
+var failOpen bool
+var singleUse bool
+var bindRequest bool
+var keyFile string
+var verifyKeyFiles strs
+var hmacKeyFile string
+var perQueueKeys bool
+var verifyCache int
+var globalRate float64
+var globalBurst int
+var reserveRate float64
+var reserveBurst int
+var clientBurst int
+var clientEvery time.Duration = time.Second
+var trustProxy bool
+var trustedProxies strs
+var corsOrigins strs
+var forwardedFirst bool
+var reservationQuery string
+var logJSON bool
+var logLevel slog.Level
+var forwardHeaders bool
+var forwardQueue bool
+var strictQueue bool
+var randomDowngrade bool
+var borrowDepth int
+var forwardClient bool
+var forwardExpires bool
+var observeOnly bool
+var maxReservationDelay time.Duration
+var reservationTTL time.Duration
+var reservationConfirm time.Duration
+var maxPending int
+var maxWaiters int
+var maxHold time.Duration
+var jitter float64
+var statsWindow time.Duration
+var upgradeQueue int = -1
+var upgradeBypass bool
+var reservationCookie string
+var tlsCert string
+var tlsKey string
+var tlsRedirect bool
+var shutdownTimeout time.Duration = 30 * time.Second
+var configFile string
 var legalFlag bool
 
 func init() {
-	flag.Var(&qrates, "queue", "number of allowed requests per second")
-	flag.StringVar(&redirectTarget, "target", redirectTarget, "target to proxy to")
+	flag.StringVar(&configFile, "config", configFile, "json file to read configuration from, overridden by command line flags (yaml is not supported)")
+	flag.Var(&qrates, "queue", "number of allowed requests per refill duration, one second by default (may be repeated)")
+	flag.Var(&qevery, "every", "duration over which each queue admits its number of requests, given once per queue (default 1s)")
+	flag.Var(&redirectTargets, "target", "target to proxy to (may be repeated to balance between several targets)")
+	flag.StringVar(&balance, "balance", balance, "strategy to balance between several targets, either \""+balanceRoundRobin+"\" or \""+balanceLeastConn+"\"")
 
-	flag.StringVar(&bindAddress, "bind", bindAddress, "address to bind to")
+	flag.StringVar(&bindAddress, "bind", bindAddress, "address to bind to, or unix:/path/to.sock to listen on a unix domain socket")
+	flag.StringVar(&controlPath, "control", controlPath, "path of the status and reservation endpoint")
+	flag.StringVar(&controlAddress, "control-bind", controlAddress, "address to serve the status and reservation endpoint on instead of the proxy address")
+	flag.StringVar(&metricsAddress, "metrics", metricsAddress, "address to serve prometheus metrics on (disabled when empty)")
+	flag.BoolVar(&singleUse, "single-use", singleUse, "reject reservations that are used more than once")
+	flag.BoolVar(&failOpen, "fail-open", failOpen, "let requests through when an internal error prevents deciding on them, rather than rejecting them")
+	flag.BoolVar(&bindRequest, "bind-request", bindRequest, "bind reservations to the method and path of the request declared when making them")
+	flag.StringVar(&keyFile, "key", keyFile, "file to persist the reservation signing key in (generated if it does not exist)")
+	flag.Var(&verifyKeyFiles, "verify-key", "key file of a previous key to still accept reservations from (may be repeated)")
+	flag.BoolVar(&perQueueKeys, "per-queue-keys", perQueueKeys, "sign reservations of each queue with a separate key derived from the signing key")
+	flag.IntVar(&verifyCache, "verify-cache", verifyCache, "number of verified reservations to remember, to only check their signature once (disabled when zero)")
+	flag.StringVar(&hmacKeyFile, "hmac-key", hmacKeyFile, "file containing a shared secret to sign shorter reservations using hmac instead of a keypair")
+	flag.Float64Var(&globalRate, "global-rate", globalRate, "requests per second admitted across all queues (disabled when zero)")
+	flag.IntVar(&globalBurst, "global-burst", globalBurst, "number of requests admitted at once across all queues (defaults to the global rate, rounded up)")
+	flag.Float64Var(&reserveRate, "reserve-rate", reserveRate, "reservation requests per second accepted by the control endpoint (disabled when zero)")
+	flag.IntVar(&reserveBurst, "reserve-burst", reserveBurst, "number of reservation requests accepted at once (defaults to the reservation rate, rounded up)")
+	flag.IntVar(&clientBurst, "client-burst", clientBurst, "number of requests each client may make at once (disabled when zero)")
+	flag.DurationVar(&clientEvery, "client-every", clientEvery, "refill duration of the limit of each client")
+	flag.BoolVar(&trustProxy, "trust-proxy", trustProxy, "identify clients using the X-Forwarded-For header")
+	flag.Var(&corsOrigins, "cors-origin", "origin allowed to make cross-origin requests to the control endpoint, such as https://dashboard.example.com (may be repeated)")
+	flag.Var(&trustedProxies, "trusted-proxy", "prefix of proxies whose X-Forwarded-For header is trusted, such as 10.0.0.0/8 (may be repeated)")
+	flag.BoolVar(&forwardedFirst, "forwarded-first", forwardedFirst, "identify clients using the first entry of a trusted X-Forwarded-For header, rather than the rightmost untrusted one")
+	flag.StringVar(&reservationQuery, "reservation-query", reservationQuery, "query parameter to additionally accept reservations from")
+	flag.StringVar(&reservationCookie, "reservation-cookie", reservationCookie, "cookie to additionally accept reservations from")
+	flag.BoolVar(&logJSON, "log-json", logJSON, "log structured records in json format")
+	flag.TextVar(&logLevel, "log-level", logLevel, "minimum level of events to log, set to DEBUG to log every request")
+	flag.BoolVar(&forwardHeaders, "forward-headers", forwardHeaders, "tell the target about the queue and delay of each request using headers")
+	flag.BoolVar(&forwardQueue, "forward-queue", forwardQueue, "tell the target about the queue of each request using a header")
+	flag.BoolVar(&forwardClient, "forward-client", forwardClient, "tell the target about the client using the X-Forwarded-For and X-Real-IP headers")
+	flag.IntVar(&borrowDepth, "borrow-depth", borrowDepth, "maximum number of lower queues to admit requests into, 0 for all")
+	flag.BoolVar(&randomDowngrade, "random-downgrade", randomDowngrade, "admit requests a queue can not admit immediately into a lower queue picked randomly, rather than the one with the lowest delay")
+	flag.BoolVar(&strictQueue, "strict-queue", strictQueue, "reject requests whose X-Blitz-Queue header is malformed or names no existing queue")
+	flag.BoolVar(&forwardExpires, "forward-expires", forwardExpires, "tell the target when the reservation of each request expires using a header")
+	flag.BoolVar(&observeOnly, "observe-only", observeOnly, "only log and record delays, but forward all requests immediately")
+	flag.Float64Var(&jitter, "jitter", jitter, "fraction of the refill duration to randomly add to delays, between 0 and 1")
+	flag.IntVar(&upgradeQueue, "upgrade-queue", upgradeQueue, "queue to admit requests upgrading the connection into, such as websockets (disabled when negative)")
+	flag.BoolVar(&upgradeBypass, "upgrade-bypass", upgradeBypass, "forward requests upgrading the connection, such as websockets, without waiting")
+	flag.DurationVar(&maxHold, "max-hold", maxHold, "maximum delay to hold requests for, longer delays are rejected (unlimited when zero)")
+	flag.IntVar(&maxWaiters, "max-waiters", maxWaiters, "maximum number of requests waiting at once, further requests are rejected (unlimited when zero)")
+	flag.DurationVar(&statsWindow, "stats-window", statsWindow, "duration to average the delays reported in the status over (ten times the refill duration when zero)")
+	flag.DurationVar(&reservationTTL, "reservation-ttl", reservationTTL, "duration reservations are valid for (refill duration of their queue when zero)")
+	flag.DurationVar(&maxReservationDelay, "max-reservation-delay", maxReservationDelay, "maximum delay of reservations (unlimited when zero)")
+	flag.DurationVar(&reservationConfirm, "reservation-confirm", reservationConfirm, "time to confirm reservations in before they are cancelled (disabled when zero)")
+	flag.IntVar(&maxPending, "max-pending", maxPending, "maximum number of reservations waiting to be confirmed at once (10000 when zero)")
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "certificate file to serve https with (requires -tls-key)")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "private key file to serve https with (requires -tls-cert)")
+	flag.BoolVar(&tlsRedirect, "tls-redirect", tlsRedirect, "additionally listen on port 80 and redirect to https (requires -tls-cert and -tls-key)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "time to wait for requests to complete when shutting down")
 	flag.BoolVar(&legalFlag, "legal", legalFlag, "print legal notices and exit")
 
 	flag.Parse()
@@ -29,10 +133,49 @@ func init() {
 		os.Exit(0)
 	}
 
+	// load the configuration file
+	if configFile != "" {
+		c, err := loadConfig(configFile)
+		if err != nil {
+			panic(err)
+		}
+		c.apply()
+	}
+
 	// parse the redirect target
-	if redirectTarget == "" {
+	if len(redirectTargets) == 0 {
 		panic("no redirect target")
 	}
+
+	// check that there are as many refill durations as queues
+	if len(qevery) != 0 && len(qevery) != len(qrates) {
+		panic(fmt.Sprintf("got %d refill durations for %d queues: -every must be given once per queue or not at all", len(qevery), len(qrates)))
+	}
+
+	// check that tls is configured completely
+	if (tlsCert == "") != (tlsKey == "") {
+		panic("-tls-cert and -tls-key must be given together")
+	}
+	if tlsRedirect && tlsCert == "" {
+		panic("-tls-redirect requires -tls-cert and -tls-key")
+	}
+}
+
+// queueConfigs returns the configuration of each queue.
+// Queues given using flags take precedence over those from the configuration file.
+func queueConfigs() []blitz.QueueConfig {
+	if len(qrates) == 0 {
+		return fileQueues
+	}
+
+	configs := make([]blitz.QueueConfig, len(qrates))
+	for i, rate := range qrates {
+		configs[i].Rate = rate
+		if len(qevery) != 0 {
+			configs[i].Every = qevery[i]
+		}
+	}
+	return configs
 }
 
 // Created so that multiple integers (for rps) can be accepted
@@ -58,3 +201,42 @@ func (q *queues) Set(value string) error {
 	*q = append(*q, u)
 	return nil
 }
+
+// Created so that multiple durations (for refills) can be accepted
+type durations []time.Duration
+
+func (d *durations) String() string {
+	if d == nil {
+		return "<nil>"
+	}
+
+	flags := make([]string, len(*d))
+	for i, d := range *d {
+		flags[i] = d.String()
+	}
+	return strings.Join(flags, ",")
+}
+
+func (d *durations) Set(value string) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = append(*d, v)
+	return nil
+}
+
+// Created so that multiple strings can be accepted
+type strs []string
+
+func (s *strs) String() string {
+	if s == nil {
+		return "<nil>"
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *strs) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
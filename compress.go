@@ -0,0 +1,74 @@
+package blitz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minCompressLength is the minimum length of a response body to compress.
+// Compressing smaller bodies saves little, or even grows them.
+const minCompressLength = 1024
+
+// gzipWriters holds gzip writers for reuse, as each one allocates large buffers.
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// acceptsGzip checks if the client making the given request accepts gzip-compressed responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+
+			// "gzip;q=0" explicitly refuses gzip
+			key, q, ok := strings.Cut(strings.TrimSpace(params), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(key), "q") {
+				if weight, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// writeCompressed writes the given body as the response to r.
+// If the client accepts it and the body is large enough, it is compressed using gzip.
+func writeCompressed(w http.ResponseWriter, r *http.Request, body []byte) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(body) < minCompressLength || !acceptsGzip(r) {
+		w.Write(body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+
+	gz.Reset(w)
+	gz.Write(body)
+	gz.Close()
+}
+
+// writeJSON writes the given value as a json response to r, compressing it if possible.
+func writeJSON(w http.ResponseWriter, r *http.Request, value any) {
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(value)
+
+	w.Header().Set("Content-Type", "application/json")
+	writeCompressed(w, r, body.Bytes())
+}
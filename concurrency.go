@@ -0,0 +1,35 @@
+package blitz
+
+import (
+	"context"
+)
+
+// acquireConcurrent marks a request admitted into the given queue as in flight.
+// If wait is true and the queue limits concurrent requests, it first waits until fewer than [QueueConfig.MaxConcurrent] requests are in flight.
+//
+// If ctx is done or the server is closed while waiting, returns an error.
+// Otherwise, [Blitz.releaseConcurrent] must be called once the request completes.
+func (blitz *Blitz) acquireConcurrent(ctx context.Context, queue int, wait bool) error {
+	if sem := blitz.concurrent[queue]; sem != nil && wait {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-blitz.closed:
+			return errClosed
+		}
+	}
+
+	blitz.counters[queue].inflight.Add(1)
+	return nil
+}
+
+// releaseConcurrent marks a request admitted into the given queue as completed.
+// wait must be the value passed to the corresponding call to [Blitz.acquireConcurrent].
+func (blitz *Blitz) releaseConcurrent(queue int, wait bool) {
+	blitz.counters[queue].inflight.Add(-1)
+
+	if sem := blitz.concurrent[queue]; sem != nil && wait {
+		<-sem
+	}
+}
@@ -0,0 +1,150 @@
+package blitz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// configPath is the path of the configuration endpoint, relative to the control path.
+const configPath = "config"
+
+var (
+	errQueueNotFound = errors.New("queue not found")
+	errInvalidRate   = errors.New("rate must be positive")
+	errInvalidEvery  = errors.New("refill duration must not be negative")
+)
+
+// queueEvery returns the refill duration of the given queue.
+func (blitz *Blitz) queueEvery(queue int) time.Duration {
+	blitz.queuesLock.RLock()
+	defer blitz.queuesLock.RUnlock()
+
+	return blitz.queues[queue].Every
+}
+
+// QueueCount returns the number of queues of the server.
+// Valid queue indexes range from 0 to QueueCount() - 1.
+func (blitz *Blitz) QueueCount() int {
+	return len(blitz.limiters)
+}
+
+// QueueConfig returns the rate and refill duration of the queue with the given index.
+// If no such queue exists, returns false.
+func (blitz *Blitz) QueueConfig(index int) (rate uint64, every time.Duration, ok bool) {
+	if index < 0 || index >= len(blitz.limiters) {
+		return 0, 0, false
+	}
+
+	blitz.queuesLock.RLock()
+	defer blitz.queuesLock.RUnlock()
+
+	return blitz.queues[index].Rate, blitz.queues[index].Every, true
+}
+
+// SetQueueRate changes the rate and refill duration of the queue with the given index at runtime.
+// A refill duration of zero uses the refill duration of the server, see [WithRefill].
+// A burst set using [QueueConfig.Burst] is kept, otherwise the burst follows the new rate.
+//
+// Reservations that have already been made, as well as the statistics of the queue, remain valid.
+func (blitz *Blitz) SetQueueRate(index int, rps uint64, every time.Duration) error {
+	if index < 0 || index >= len(blitz.limiters) {
+		return errQueueNotFound
+	}
+	if rps == 0 {
+		return errInvalidRate
+	}
+	if every < 0 {
+		return errInvalidEvery
+	}
+	if every == 0 {
+		every = blitz.every
+	}
+
+	config := QueueConfig{Rate: rps, Every: every, Burst: blitz.queues[index].Burst}
+	if err := config.validate(index); err != nil {
+		return err
+	}
+
+	blitz.queuesLock.Lock()
+	defer blitz.queuesLock.Unlock()
+
+	blitz.queues[index].Rate = rps
+	blitz.queues[index].Every = every
+
+	limiter := blitz.limiters[index]
+	limiter.SetLimit(blitz.queues[index].limit())
+	limiter.SetBurst(blitz.queues[index].burst())
+	return nil
+}
+
+// queueRate is the body of a request to the configuration endpoint
+type queueRate struct {
+	Queue               int
+	Rate                uint64
+	EveryInMilliseconds int64
+}
+
+// serveConfig serves the configuration endpoint, which changes the rate of a queue.
+// It is only available when [Blitz.ConfigAuth] is set.
+func (blitz *Blitz) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if blitz.ConfigAuth == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !blitz.ConfigAuth(r) {
+		serveUnauthorized(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		serveMethodNotAllowed(w, r)
+		return
+	}
+
+	var body queueRate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Bad Request: %v", err), 0)
+		return
+	}
+
+	if err := blitz.SetQueueRate(body.Queue, body.Rate, time.Duration(body.EveryInMilliseconds)*time.Millisecond); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Bad Request: %v", err), 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blitz.Status())
+}
+
+// ResetStats discards the statistics of all queues, such as the delays reported by [Blitz.Status], along with all series.
+// Counters of forwarded requests and reservations are not affected.
+func (blitz *Blitz) ResetStats() {
+	for _, s := range blitz.stats {
+		s.Reset()
+	}
+	for _, series := range blitz.allSeries() {
+		for _, s := range series.stats {
+			s.Reset()
+		}
+	}
+}
+
+// serveReset serves a request to reset the statistics.
+// Like the configuration endpoint, it is only available when [Blitz.ConfigAuth] is set.
+func (blitz *Blitz) serveReset(w http.ResponseWriter, r *http.Request) {
+	if blitz.ConfigAuth == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !blitz.ConfigAuth(r) {
+		serveUnauthorized(w, r)
+		return
+	}
+
+	blitz.ResetStats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blitz.Status())
+}
@@ -0,0 +1,135 @@
+package blitz
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// confirmPath is the path of the confirmation endpoint, relative to the control path.
+const confirmPath = "confirm"
+
+// DefaultMaxPendingConfirmations is the default maximum number of reservations waiting to be confirmed, see [WithMaxPendingConfirmations].
+const DefaultMaxPendingConfirmations = 10_000
+
+var (
+	errReservationUnknown   = errors.New("reservation was not issued by this instance")
+	errReservationAbandoned = errors.New("reservation was not confirmed in time")
+	errMissingReservation   = errors.New("no reservation given")
+)
+
+// pendingState is the state of a reservation that has to be confirmed
+type pendingState int
+
+const (
+	statePending   pendingState = iota // not yet confirmed
+	stateConfirmed                     // confirmed, or used
+	stateAbandoned                     // not confirmed in time, and cancelled
+)
+
+// pendingReservation is a reservation that has to be confirmed, see [WithReservationConfirm].
+type pendingReservation struct {
+	admission admission
+	cost      int // number of slots used up in the queue
+	state     pendingState
+	timer     *time.Timer // abandons the reservation unless confirmed in time, and then forgets it once it expired
+}
+
+// confirmations holds reservations that have to be confirmed.
+type confirmations struct {
+	m       sync.Mutex
+	pending map[[nonceLength]byte]*pendingReservation
+	limit   int // maximum number of pending reservations
+}
+
+// provision records the reservation for the given token and admission, which has to be confirmed within the grace period.
+// If not, the reservation is abandoned.
+// The reservation is forgotten once the token has expired.
+//
+// If too many reservations are recorded already, returns false.
+func (blitz *Blitz) provision(t token, a admission, cost int) bool {
+	c := blitz.confirms
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if len(c.pending) >= c.limit {
+		return false
+	}
+
+	p := &pendingReservation{admission: a, cost: cost}
+	c.pending[t.Nonce] = p
+
+	p.timer = time.AfterFunc(blitz.confirmGrace, func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+
+		if p.state == statePending {
+			p.state = stateAbandoned
+			blitz.abandon(p)
+		}
+
+		// the token is still valid => keep it until it expires, so that using it is rejected as abandoned rather than unknown
+		if remaining := t.Until.Add(blitz.skew).Sub(blitz.clock.Now()); remaining > 0 {
+			p.timer.Reset(remaining)
+			return
+		}
+		delete(c.pending, t.Nonce)
+	})
+	return true
+}
+
+// abandon returns the slots of the given reservation to its queue and the global limiter.
+func (blitz *Blitz) abandon(p *pendingReservation) {
+	blitz.counters[p.admission.Queue].abandoned.Add(1)
+	blitz.returnSlots(p.admission, p.cost)
+}
+
+// confirm confirms the reservation with the given nonce.
+// Confirming a reservation more than once is not an error.
+func (blitz *Blitz) confirm(nonce [nonceLength]byte) error {
+	c := blitz.confirms
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	p, ok := c.pending[nonce]
+	switch {
+	case !ok:
+		return errReservationUnknown
+	case p.state == stateAbandoned:
+		return errReservationAbandoned
+	}
+
+	p.state = stateConfirmed
+	return nil
+}
+
+// serveConfirm serves a request confirming a reservation.
+func (blitz *Blitz) serveConfirm(w http.ResponseWriter, r *http.Request) {
+	if blitz.confirms == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		serveMethodNotAllowed(w, r)
+		return
+	}
+
+	err := errMissingReservation
+	if reservation := blitz.findReservation(r); reservation != "" {
+		var t token
+		if t, err = blitz.signer.Decode(reservation); err == nil {
+			err = blitz.confirm(t.Nonce)
+		}
+	}
+	if err != nil {
+		blitz.logEvent(event{Name: eventBadReservation, Client: blitz.clientAddr(r), Queue: -1, Err: err})
+		writeError(w, r, http.StatusBadRequest, CodeBadReservation, fmt.Sprintf("Bad Request: %v", err), 0)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,78 @@
+package blitz
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAbandonThroughput(t *testing.T) {
+	const burst = 10
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		reserve int
+
+		wantAbandoned uint64
+		wantAllowed   int
+	}{
+		{"unconfirmed", nil, burst, 0, 0},
+		{"abandoned without delay", []Option{WithReservationConfirm(10 * time.Millisecond)}, burst, burst, burst},
+		{"abandoned with delay", []Option{WithReservationConfirm(10 * time.Millisecond)}, burst + 5, burst + 5, burst},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the clock never moves, so slots only come back from abandoned reservations
+			blitz := newTestBlitz(t, append(tt.opts, WithClock(newFakeClock()), WithQueues([]uint64{burst}), WithRefill(time.Second))...)
+
+			for i := 0; i < tt.reserve; i++ {
+				if status, rs := requestReservation(t, blitz, nil); status != http.StatusOK || !rs.Success {
+					t.Fatalf("reservation %d = %d %q, want success", i, status, rs.Code)
+				}
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for blitz.counters[0].abandoned.Load() < tt.wantAbandoned && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := blitz.counters[0].abandoned.Load(); got != tt.wantAbandoned {
+				t.Fatalf("abandoned = %d, want %d", got, tt.wantAbandoned)
+			}
+
+			allowed := 0
+			for i := 0; i < 2*burst; i++ {
+				if blitz.Allow(0) {
+					allowed++
+				}
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("Allow() succeeded %d times, want %d", allowed, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestMaxPendingConfirmations(t *testing.T) {
+	blitz := newTestBlitz(t, WithClock(newFakeClock()), WithQueues([]uint64{5}), WithRefill(time.Second), WithReservationConfirm(time.Hour), WithMaxPendingConfirmations(1))
+
+	if status, rs := requestReservation(t, blitz, nil); status != http.StatusOK || !rs.Success {
+		t.Fatalf("first reservation = %d %q, want success", status, rs.Code)
+	}
+
+	status, rs := requestReservation(t, blitz, nil)
+	if status != http.StatusTooManyRequests || rs.Code != CodeRateLimited || rs.RetryAfterMs != time.Hour.Milliseconds() {
+		t.Errorf("second reservation = %d %q retry %dms, want %d %q retry %dms", status, rs.Code, rs.RetryAfterMs, http.StatusTooManyRequests, CodeRateLimited, time.Hour.Milliseconds())
+	}
+
+	// the rejected reservation must not use up a slot
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if blitz.Allow(0) {
+			allowed++
+		}
+	}
+	if allowed != 4 {
+		t.Errorf("Allow() succeeded %d times, want %d", allowed, 4)
+	}
+}
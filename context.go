@@ -0,0 +1,51 @@
+package blitz
+
+import (
+	"context"
+	"time"
+)
+
+// contextKey is the type of keys of context values set by blitz.
+type contextKey int
+
+const (
+	queueContextKey contextKey = iota
+	delayContextKey
+	spanContextKey
+	expiresContextKey
+	nextContextKey
+)
+
+// withQueue returns a copy of ctx carrying the given queue index and delay.
+func withQueue(ctx context.Context, queue int, delay time.Duration) context.Context {
+	ctx = context.WithValue(ctx, queueContextKey, queue)
+	ctx = context.WithValue(ctx, delayContextKey, delay)
+	return ctx
+}
+
+// QueueFromContext returns the index of the queue a request was admitted into by blitz.
+// It is available in the context of requests forwarded to [Blitz.Handler] and passed to [Blitz.OnReject].
+func QueueFromContext(ctx context.Context) (int, bool) {
+	queue, ok := ctx.Value(queueContextKey).(int)
+	return queue, ok
+}
+
+// DelayFromContext returns the delay of a request computed by blitz.
+// For requests forwarded to [Blitz.Handler], it is the duration the request actually waited.
+// For requests passed to [Blitz.OnReject], it is typically infinite.
+func DelayFromContext(ctx context.Context) (time.Duration, bool) {
+	delay, ok := ctx.Value(delayContextKey).(time.Duration)
+	return delay, ok
+}
+
+// withExpires returns a copy of ctx carrying the time the reservation of a request expires.
+func withExpires(ctx context.Context, expires time.Time) context.Context {
+	return context.WithValue(ctx, expiresContextKey, expires)
+}
+
+// ExpiresFromContext returns the time the reservation used by a request expires, if it used one.
+// It is available in the context of requests forwarded to [Blitz.Handler].
+func ExpiresFromContext(ctx context.Context) (time.Time, bool) {
+	expires, ok := ctx.Value(expiresContextKey).(time.Time)
+	return expires, ok
+}
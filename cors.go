@@ -0,0 +1,64 @@
+package blitz
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsHeaders are the request headers browsers may send to the control endpoint from other origins.
+var corsHeaders = strings.Join([]string{
+	"Accept",
+	"Authorization",
+	"Content-Type",
+	HeaderProtocol,
+	HeaderQueue,
+	HeaderCount,
+	HeaderReservation,
+	HeaderBindMethod,
+	HeaderBindPath,
+}, ", ")
+
+// corsExposedHeaders are the response headers of the control endpoint that browsers expose to scripts of other origins.
+var corsExposedHeaders = strings.Join([]string{
+	"Retry-After",
+	HeaderProtocol,
+}, ", ")
+
+// allowsOrigin checks if requests to the control endpoint from the given origin are allowed.
+// It returns the value of the Access-Control-Allow-Origin header to send, and true if they are.
+func (blitz *Blitz) allowsOrigin(origin string) (string, bool) {
+	switch {
+	case origin == "" || len(blitz.corsOrigins) == 0:
+		return "", false
+	case slices.Contains(blitz.corsOrigins, "*"):
+		return "*", true
+	case slices.Contains(blitz.corsOrigins, origin):
+		return origin, true
+	default:
+		return "", false
+	}
+}
+
+// setCORSHeaders sets the headers allowing a cross-origin request to the control endpoint, if the origin of r is allowed.
+// For preflight requests, it additionally sets the methods and headers allowed at the path of r.
+func (blitz *Blitz) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	if len(blitz.corsOrigins) == 0 {
+		return
+	}
+
+	header := w.Header()
+	header.Add("Vary", "Origin")
+
+	allow, ok := blitz.allowsOrigin(r.Header.Get("Origin"))
+	if !ok {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", allow)
+	header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+
+	if r.Method == http.MethodOptions {
+		header.Set("Access-Control-Allow-Methods", strings.Join(blitz.controlMethods(r.URL.Path), ", "))
+		header.Set("Access-Control-Allow-Headers", corsHeaders)
+	}
+}
@@ -0,0 +1,63 @@
+package blitz
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Codes of errors sent by blitz itself, in addition to the codes of reservations such as [CodeQueueFull].
+// They are sent in the code field of json error responses, see [ErrorBody].
+const (
+	CodeBadRequest       = "bad_request"        // the request is malformed
+	CodeBadReservation   = "bad_reservation"    // the reservation used is invalid
+	CodeMethodNotAllowed = "method_not_allowed" // the endpoint does not support the method
+	CodeUnauthorized     = "unauthorized"       // an authentication hook denied the request
+	CodeNotAcceptable    = "not_acceptable"     // the protocol version requested is not supported
+	CodeUnavailable      = "unavailable"        // the server is shutting down, or too many requests are waiting
+	CodeCancelled        = "cancelled"          // the client went away while the request was waiting
+	CodeTimeout          = "timeout"            // the deadline of the request passed while it was waiting
+	CodeInternal         = "internal"           // an internal error occurred, such as failing to sign a reservation
+)
+
+// ErrorBody is the body of error responses sent by blitz to clients accepting json.
+// Clients that do not accept json receive the message as plain text instead.
+type ErrorBody struct {
+	Error        string `json:"error"`                    // human-readable message
+	Code         string `json:"code"`                     // one of the Code constants
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"` // time to wait before retrying, if known
+}
+
+// acceptsJSON checks if the client making the given request accepts json responses.
+func acceptsJSON(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, typ := range strings.Split(value, ",") {
+			if mediaType, _, err := mime.ParseMediaType(typ); err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeError responds to r with an error of the given status, code and human-readable message.
+// If the client accepts json, the body is an [ErrorBody] including retry if it is positive.
+// Otherwise, it is the message as plain text.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, retry time.Duration) {
+	if !acceptsJSON(r) {
+		http.Error(w, message, status)
+		return
+	}
+
+	body := ErrorBody{Error: message, Code: code}
+	if retry > 0 {
+		body.RetryAfterMs = retry.Milliseconds()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
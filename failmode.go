@@ -0,0 +1,40 @@
+package blitz
+
+import (
+	"errors"
+	"fmt"
+)
+
+// FailMode decides how requests are handled when an internal error prevents deciding on them, see [WithFailMode].
+type FailMode int
+
+const (
+	// FailClosed rejects requests that can not be decided on.
+	// It protects the handler, at the cost of availability.
+	FailClosed FailMode = iota
+
+	// FailOpen lets requests that can not be decided on through.
+	// It keeps serving clients, at the cost of protecting the handler.
+	FailOpen
+)
+
+// String returns "closed" or "open".
+func (mode FailMode) String() string {
+	switch mode {
+	case FailClosed:
+		return "closed"
+	case FailOpen:
+		return "open"
+	default:
+		return fmt.Sprintf("FailMode(%d)", int(mode))
+	}
+}
+
+var errNonceStore = errors.New("nonce store failed")
+
+// failOpen logs an internal error that prevents deciding on a request of the given client, along with the decision taken.
+// It returns true if the request should be let through.
+func (blitz *Blitz) failOpen(name, client string, queue int, err error) bool {
+	blitz.logEvent(event{Name: name, Client: client, Queue: queue, Err: fmt.Errorf("%w, failing %s", err, blitz.failMode)})
+	return blitz.failMode == FailOpen
+}
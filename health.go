@@ -0,0 +1,62 @@
+package blitz
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// healthPath is the path of the health endpoint, relative to the control path.
+const healthPath = "health"
+
+// States reported by the health endpoint.
+const (
+	healthServing  = "serving"
+	healthDraining = "draining"
+)
+
+// Health describes if the server is ready to take requests.
+type Health struct {
+	// State is "serving" when serving normally, and "draining" while shutting down.
+	State string
+
+	// Saturation of each queue, 0 when all slots are available and 1 when none are.
+	// Values above 1 indicate that requests are waiting for the queue to refill.
+	Saturation []float64
+}
+
+// Health returns the current health of the server.
+func (blitz *Blitz) Health() (h Health) {
+	h.State = healthServing
+	if blitz.isDraining() {
+		h.State = healthDraining
+	}
+
+	now := blitz.clock.Now()
+	h.Saturation = make([]float64, len(blitz.limiters))
+	for i, l := range blitz.limiters {
+		if burst := l.Burst(); burst > 0 {
+			h.Saturation[i] = max(1-l.TokensAt(now)/float64(burst), 0)
+		} else {
+			h.Saturation[i] = 1
+		}
+	}
+	return
+}
+
+// serveHealth serves the health endpoint.
+// It responds with [net/http.StatusOK] when serving normally, and [net/http.StatusServiceUnavailable] while draining.
+func (blitz *Blitz) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		serveMethodNotAllowed(w, r)
+		return
+	}
+
+	health := blitz.Health()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if health.State != healthServing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,211 @@
+package blitz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultClientRetries is the default number of times a [Client] retries a request whose reservation expired.
+const DefaultClientRetries = 3
+
+// Client sends requests to a server protected by blitz using reservations.
+// For each request, it makes a reservation, waits until it becomes valid, and then sends the request using it.
+type Client struct {
+	// Client is used to send all requests, nil means [http.DefaultClient].
+	Client *http.Client
+
+	// Control is the url of the status and reservation endpoint, for example "http://localhost:8080/blitz/".
+	Control string
+
+	// Retries is the number of times a request is retried with a new reservation when the previous one expired.
+	// Requests with a body can only be retried if [http.Request.GetBody] is set.
+	Retries int
+
+	// Confirm sets if reservations are confirmed immediately after making them.
+	// This is required if the server only accepts confirmed reservations, see [WithReservationConfirm].
+	Confirm bool
+}
+
+// NewClient creates a new client making reservations at the given control url.
+func NewClient(control string) *Client {
+	return &Client{Control: control, Retries: DefaultClientRetries}
+}
+
+// ReservationError is returned by a [Client] when a reservation is not successful.
+type ReservationError struct {
+	Code       string        // one of the Code constants
+	Message    string        // human-readable reason
+	RetryAfter time.Duration // time to wait before reserving again, if known
+}
+
+func (err *ReservationError) Error() string {
+	return fmt.Sprintf("reservation failed: %s (%s)", err.Message, err.Code)
+}
+
+var errReservationStatus = errors.New("unexpected response to reservation request")
+
+func (c *Client) client() *http.Client {
+	if c.Client == nil {
+		return http.DefaultClient
+	}
+	return c.Client
+}
+
+// Do makes a reservation for req, waits until it becomes valid and then sends req using it.
+// The queue of the reservation is taken from the [HeaderQueue] header of req, if any.
+//
+// If the reservation expires before req arrives, a new reservation is made, at most [Client.Retries] times.
+// Cancelling the context of req stops waiting.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		rs, err := c.Reserve(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if c.Confirm {
+			if err := c.ConfirmReservation(ctx, rs); err != nil {
+				return nil, err
+			}
+		}
+
+		// wait until the reservation should be used
+		if err := sleep(ctx, time.Until(time.UnixMilli(rs.SendAtUnixMilliseconds))); err != nil {
+			return nil, err
+		}
+
+		// send the request using the reservation, unless the server could not sign one
+		send := req.Clone(ctx)
+		if rs.Code != CodeUnsigned {
+			send.Header.Set(HeaderReservation, rs.XBlitzReservation)
+		}
+		if attempt > 0 && req.GetBody != nil {
+			if send.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		res, err := c.client().Do(send)
+		if err != nil {
+			return nil, err
+		}
+
+		// retry only if the reservation expired and the body can be sent again
+		if attempt >= c.Retries || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+			return res, nil
+		}
+		if !isExpired(res) {
+			return res, nil
+		}
+		res.Body.Close()
+	}
+}
+
+// isExpired checks if res reports that a reservation has expired.
+// If not, the body of res is left intact.
+func isExpired(res *http.Response) bool {
+	if res.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	if typ, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); typ != "application/json" {
+		return false
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+
+	var rs Reservation
+	return json.Unmarshal(body, &rs) == nil && rs.Code == CodeExpired
+}
+
+// Reserve makes a reservation for req, without sending it.
+// If the reservation is not successful, the error is a [*ReservationError].
+func (c *Client) Reserve(ctx context.Context, req *http.Request) (rs Reservation, err error) {
+	reserve, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Control, nil)
+	if err != nil {
+		return rs, err
+	}
+	if queue := req.Header.Get(HeaderQueue); queue != "" {
+		reserve.Header.Set(HeaderQueue, queue)
+	}
+	reserve.Header.Set(HeaderProtocol, strconv.Itoa(ProtocolVersion))
+	reserve.Header.Set(HeaderBindMethod, req.Method)
+	reserve.Header.Set(HeaderBindPath, req.URL.Path)
+
+	res, err := c.client().Do(reserve)
+	if err != nil {
+		return rs, err
+	}
+	defer res.Body.Close()
+
+	if typ, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); typ != "application/json" {
+		return rs, fmt.Errorf("%w: %s", errReservationStatus, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rs); err != nil {
+		return rs, err
+	}
+	if !rs.Success {
+		return rs, &ReservationError{
+			Code:       rs.Code,
+			Message:    rs.Message,
+			RetryAfter: time.Duration(rs.RetryAfterMs) * time.Millisecond,
+		}
+	}
+	return rs, nil
+}
+
+// ConfirmReservation confirms the given reservation, see [WithReservationConfirm].
+// Reservations without a token, see [CodeUnsigned], need no confirmation.
+func (c *Client) ConfirmReservation(ctx context.Context, rs Reservation) error {
+	if rs.Code == CodeUnsigned {
+		return nil
+	}
+
+	confirm, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.Control, "/")+"/"+confirmPath, nil)
+	if err != nil {
+		return err
+	}
+	confirm.Header.Set(HeaderProtocol, strconv.Itoa(ProtocolVersion))
+	confirm.Header.Set(HeaderReservation, rs.XBlitzReservation)
+
+	res, err := c.client().Do(confirm)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%w: %s", errReservationStatus, res.Status)
+	}
+	return nil
+}
+
+// sleep waits for the given duration, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
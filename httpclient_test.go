@@ -0,0 +1,53 @@
+package blitz
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failingSigner is a [Signer] that always fails.
+type failingSigner struct{}
+
+func (failingSigner) PublicKey() [32]byte { return [32]byte{} }
+
+func (failingSigner) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	return nil, errors.New("signer unavailable")
+}
+
+func TestClientUnsigned(t *testing.T) {
+	blitz := newTestBlitz(t, WithSigner(failingSigner{}), WithFailMode(FailOpen), WithReservationConfirm(time.Second), WithQueues([]uint64{1}))
+	server := httptest.NewServer(blitz)
+	defer server.Close()
+
+	client := NewClient(server.URL + DefaultControlPath)
+	client.Confirm = true
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := client.Reserve(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if !rs.Success || rs.Code != CodeUnsigned || rs.XBlitzReservation != "" {
+		t.Errorf("Reserve() = success %t, code %q, token %q, want an unsigned reservation", rs.Success, rs.Code, rs.XBlitzReservation)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("Do() = %d %q, want %d %q", res.StatusCode, body, http.StatusOK, "ok")
+	}
+}
@@ -0,0 +1,155 @@
+package blitz
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// SeriesBackendLatency is the name of the series holding the time taken by the handler to serve forwarded requests, in fractional milliseconds.
+// It is always registered, see [Blitz.RecordBackendLatency].
+const SeriesBackendLatency = "backend_latency_ms"
+
+// SeriesBackendTTFB is the name of the series holding the time until the handler starts responding to forwarded requests, in fractional milliseconds.
+// It is always registered, and fed alongside [SeriesBackendLatency].
+const SeriesBackendTTFB = "backend_ttfb_ms"
+
+// latencyWriter wraps the response writer of a forwarded request, noting when the handler starts responding.
+// Use [latencyWriter.wrap] to pass it to the handler, which also exposes the optional interfaces of the underlying writer.
+type latencyWriter struct {
+	http.ResponseWriter
+	clock Clock
+
+	first    time.Time // time the handler first wrote the header or body, zero until then
+	hijacked bool      // the handler took over the connection
+}
+
+// started notes that the handler started responding, unless it did before.
+func (lw *latencyWriter) started() {
+	if lw.first.IsZero() {
+		lw.first = lw.clock.Now()
+	}
+}
+
+func (lw *latencyWriter) WriteHeader(statusCode int) {
+	lw.started()
+	lw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (lw *latencyWriter) Write(b []byte) (int, error) {
+	lw.started()
+	return lw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying response writer, for use by [http.ResponseController].
+func (lw *latencyWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// latencyFlusher, latencyHijacker and latencyReaderFrom forward an optional interface of the writer underlying a [latencyWriter].
+type (
+	latencyFlusher    struct{ lw *latencyWriter }
+	latencyHijacker   struct{ lw *latencyWriter }
+	latencyReaderFrom struct{ lw *latencyWriter }
+)
+
+func (f latencyFlusher) Flush() {
+	f.lw.started()
+	f.lw.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (h latencyHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := h.lw.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		h.lw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (r latencyReaderFrom) ReadFrom(src io.Reader) (int64, error) {
+	r.lw.started()
+	return r.lw.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+}
+
+// wrap returns lw as a response writer implementing exactly those of [http.Flusher], [http.Hijacker] and [io.ReaderFrom] that the underlying writer implements.
+// Handlers checking for these interfaces then behave as if they were passed the underlying writer.
+func (lw *latencyWriter) wrap() http.ResponseWriter {
+	_, flusher := lw.ResponseWriter.(http.Flusher)
+	_, hijacker := lw.ResponseWriter.(http.Hijacker)
+	_, readerFrom := lw.ResponseWriter.(io.ReaderFrom)
+
+	f, h, r := latencyFlusher{lw}, latencyHijacker{lw}, latencyReaderFrom{lw}
+	switch {
+	case flusher && hijacker && readerFrom:
+		return struct {
+			*latencyWriter
+			latencyFlusher
+			latencyHijacker
+			latencyReaderFrom
+		}{lw, f, h, r}
+	case flusher && hijacker:
+		return struct {
+			*latencyWriter
+			latencyFlusher
+			latencyHijacker
+		}{lw, f, h}
+	case flusher && readerFrom:
+		return struct {
+			*latencyWriter
+			latencyFlusher
+			latencyReaderFrom
+		}{lw, f, r}
+	case hijacker && readerFrom:
+		return struct {
+			*latencyWriter
+			latencyHijacker
+			latencyReaderFrom
+		}{lw, h, r}
+	case flusher:
+		return struct {
+			*latencyWriter
+			latencyFlusher
+		}{lw, f}
+	case hijacker:
+		return struct {
+			*latencyWriter
+			latencyHijacker
+		}{lw, h}
+	case readerFrom:
+		return struct {
+			*latencyWriter
+			latencyReaderFrom
+		}{lw, r}
+	default:
+		return lw
+	}
+}
+
+// RecordBackendLatency records that the handler took d in total to serve a request of the given queue.
+// Blitz records the latency of requests it forwards itself, so it only needs to be called for requests served some other way.
+func (blitz *Blitz) RecordBackendLatency(queue int, d time.Duration) {
+	blitz.backendLatency.AddDuration(queue, d)
+}
+
+// serveMeasured serves r using handler, and records how long it takes in the backend series of the given queue.
+func (blitz *Blitz) serveMeasured(handler http.Handler, w http.ResponseWriter, r *http.Request, queue int) {
+	lw := &latencyWriter{ResponseWriter: w, clock: blitz.clock}
+	start := blitz.clock.Now()
+	handler.ServeHTTP(lw.wrap(), r)
+	end := blitz.clock.Now()
+
+	// upgraded connections are held for their whole lifetime, which says nothing about the handler
+	if lw.hijacked || isUpgrade(r) {
+		return
+	}
+
+	// handlers that never write respond once they return
+	if lw.first.IsZero() {
+		lw.first = end
+	}
+
+	blitz.RecordBackendLatency(queue, end.Sub(start))
+	blitz.backendTTFB.AddDuration(queue, lw.first.Sub(start))
+}
@@ -0,0 +1,140 @@
+package blitz
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fullWriter is a response writer implementing [http.Flusher], [http.Hijacker] and [io.ReaderFrom], recording their use.
+type fullWriter struct {
+	*httptest.ResponseRecorder
+	hijacked, readFrom bool
+}
+
+func (w *fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func (w *fullWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestLatencyWriterInterfaces(t *testing.T) {
+	tests := []struct {
+		name string
+		w    func(full *fullWriter) http.ResponseWriter
+
+		wantFlusher, wantHijacker, wantReaderFrom bool
+	}{
+		{"none", func(full *fullWriter) http.ResponseWriter {
+			return struct{ http.ResponseWriter }{full}
+		}, false, false, false},
+		{"flusher", func(full *fullWriter) http.ResponseWriter {
+			return full.ResponseRecorder
+		}, true, false, false},
+		{"hijacker and reader from", func(full *fullWriter) http.ResponseWriter {
+			return struct {
+				http.ResponseWriter
+				http.Hijacker
+				io.ReaderFrom
+			}{full, full, full}
+		}, false, true, true},
+		{"all", func(full *fullWriter) http.ResponseWriter {
+			return full
+		}, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full := &fullWriter{ResponseRecorder: httptest.NewRecorder()}
+			lw := &latencyWriter{ResponseWriter: tt.w(full), clock: newFakeClock()}
+			w := lw.wrap()
+
+			flusher, isFlusher := w.(http.Flusher)
+			hijacker, isHijacker := w.(http.Hijacker)
+			readerFrom, isReaderFrom := w.(io.ReaderFrom)
+			if isFlusher != tt.wantFlusher || isHijacker != tt.wantHijacker || isReaderFrom != tt.wantReaderFrom {
+				t.Fatalf("wrap() implements flusher %t, hijacker %t, reader from %t, want %t, %t, %t", isFlusher, isHijacker, isReaderFrom, tt.wantFlusher, tt.wantHijacker, tt.wantReaderFrom)
+			}
+
+			if isReaderFrom {
+				if _, err := readerFrom.ReadFrom(strings.NewReader("body")); err != nil {
+					t.Fatalf("ReadFrom() error = %v", err)
+				}
+				if !full.readFrom || full.Body.String() != "body" || lw.first.IsZero() {
+					t.Error("ReadFrom() was not forwarded, or did not note the start of the response")
+				}
+			}
+			if isFlusher {
+				flusher.Flush()
+				if !full.Flushed || lw.first.IsZero() {
+					t.Error("Flush() was not forwarded, or did not note the start of the response")
+				}
+			}
+			if isHijacker {
+				if _, _, err := hijacker.Hijack(); err != nil {
+					t.Fatalf("Hijack() error = %v", err)
+				}
+				if !full.hijacked || !lw.hijacked {
+					t.Error("Hijack() was not forwarded, or not noted")
+				}
+			}
+
+			if unwrapped := w.(interface{ Unwrap() http.ResponseWriter }).Unwrap(); unwrapped != lw.ResponseWriter {
+				t.Error("Unwrap() does not return the underlying writer")
+			}
+		})
+	}
+}
+
+func TestServeMeasured(t *testing.T) {
+	// a real server passes a writer implementing all interfaces, which the handler has to see as well
+	var flusher, hijacker, readerFrom bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher = w.(http.Flusher)
+		_, hijacker = w.(http.Hijacker)
+		_, readerFrom = w.(io.ReaderFrom)
+		io.Copy(w, strings.NewReader("ok"))
+	})
+
+	blitz, err := NewWithOptions(handler, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the latency is recorded once the handler returned, which may be after the client received the response
+	served := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(served)
+		blitz.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	<-served
+
+	if string(body) != "ok" {
+		t.Errorf("body = %q, want %q", body, "ok")
+	}
+	if !flusher || !hijacker || !readerFrom {
+		t.Errorf("handler saw flusher %t, hijacker %t, reader from %t, want all", flusher, hijacker, readerFrom)
+	}
+	if count := blitz.Series(SeriesBackendLatency).Stats(0).Count(); count != 1 {
+		t.Errorf("backend latency count = %d, want 1", count)
+	}
+	if count := blitz.Series(SeriesBackendTTFB).Stats(0).Count(); count != 1 {
+		t.Errorf("backend ttfb count = %d, want 1", count)
+	}
+}
@@ -0,0 +1,155 @@
+package blitz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Names of events that are logged.
+const (
+	eventReserve        = "reserve"
+	eventReject         = "reject"
+	eventForward        = "forward"
+	eventBadReservation = "bad_reservation"
+	eventSignFailed     = "sign_failed"
+	eventClockStep      = "clock_step"
+	eventStoreFailed    = "store_failed"
+)
+
+var (
+	errClockStep        = errors.New("clock stepped backward")
+	errReservationEarly = errors.New("reservation is valid too far in the future, the clock may have stepped backward")
+)
+
+// event is something that happened to a request, and is logged.
+type event struct {
+	Name   string        // name of the event, one of the event constants
+	Client string        // address of the client
+	Queue  int           // index of the queue, or -1 if unknown
+	QName  string        // name of the queue, if any
+	Delay  time.Duration // delay of the request
+	Err    error         // error that occurred, if any
+
+	Observe bool // the delay or rejection was only observed, see [WithObserveOnly]
+}
+
+// String formats the event as a human-readable message.
+func (e event) String() string {
+	if e.Observe {
+		return "[observe only] " + e.message()
+	}
+	return e.message()
+}
+
+// message formats the event as a human-readable message, ignoring observe mode.
+func (e event) message() string {
+	switch e.Name {
+	case eventReserve, eventForward:
+		if e.QName != "" {
+			return fmt.Sprintf("client %q on queue %d (%s) delay %s", e.Client, e.Queue, e.QName, e.Delay)
+		}
+		return fmt.Sprintf("client %q on queue %d delay %s", e.Client, e.Queue, e.Delay)
+	case eventReject:
+		if e.Delay != rate.InfDuration {
+			return fmt.Sprintf("client %q rejected delay %s", e.Client, e.Delay)
+		}
+		return fmt.Sprintf("client %q delay ∞", e.Client)
+	case eventBadReservation:
+		return fmt.Sprintf("client %q bad reservation: %v", e.Client, e.Err)
+	case eventSignFailed:
+		return fmt.Sprintf("client %q failed to sign reservation: %v", e.Client, e.Err)
+	case eventStoreFailed:
+		return fmt.Sprintf("client %q failed to check reservation: %v", e.Client, e.Err)
+	case eventClockStep:
+		if e.Client != "" {
+			return fmt.Sprintf("client %q %v: %s too early, holding the request for less", e.Client, e.Err, e.Delay)
+		}
+		return fmt.Sprintf("%v by %s, holding the time until it catches up", e.Err, e.Delay)
+	default:
+		return fmt.Sprintf("client %q %s: %v", e.Client, e.Name, e.Err)
+	}
+}
+
+// level returns the level to log the event at.
+// Events happening to every request are only logged at debug level, as they make up most of the log volume.
+// In observe mode, forwarded requests are logged at info level, as reporting their delays is the point of observing.
+func (e event) level() slog.Level {
+	switch {
+	case e.Name == eventSignFailed, e.Name == eventStoreFailed:
+		return slog.LevelError
+	case e.Err != nil:
+		return slog.LevelWarn
+	case e.Name == eventReserve, e.Name == eventForward && !e.Observe:
+		return slog.LevelDebug
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// attrs returns the attributes of the event for structured logging.
+func (e event) attrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("event", e.Name),
+		slog.String("client", e.Client),
+	}
+	if e.Queue >= 0 {
+		attrs = append(attrs, slog.Int("queue", e.Queue))
+	}
+	if e.QName != "" {
+		attrs = append(attrs, slog.String("queue_name", e.QName))
+	}
+	if e.Observe {
+		attrs = append(attrs, slog.Bool("observe", true))
+	}
+	switch {
+	case e.Name == eventClockStep:
+		attrs = append(attrs, slog.String("error", e.Err.Error()), slog.Int64("step_ms", e.Delay.Milliseconds()))
+	case e.Err != nil:
+		attrs = append(attrs, slog.String("error", e.Err.Error()))
+	case e.Delay == rate.InfDuration:
+		attrs = append(attrs, slog.Bool("delay_infinite", true))
+	default:
+		attrs = append(attrs, slog.Int64("delay_ms", e.Delay.Milliseconds()))
+	}
+	return attrs
+}
+
+// logEvent logs the given event.
+// If a structured logger is set, it is used to emit a structured record.
+//
+// Events below the enabled level are dropped before formatting them.
+func (blitz *Blitz) logEvent(e event) {
+	e.Observe = blitz.observeOnly && (e.Name == eventForward || e.Name == eventReject)
+	level := e.level()
+	if blitz.SlogLogger != nil {
+		if !blitz.SlogLogger.Enabled(context.Background(), level) {
+			return
+		}
+	} else if level < blitz.LogLevel {
+		return
+	}
+
+	if e.Queue >= 0 && e.Queue < len(blitz.queues) {
+		e.QName = blitz.queues[e.Queue].Name
+	}
+
+	if blitz.SlogLogger != nil {
+		blitz.SlogLogger.LogAttrs(context.Background(), level, e.String(), e.attrs()...)
+		return
+	}
+	blitz.logF("%s", e)
+}
+
+func (wrap *Blitz) logF(fmt string, args ...any) {
+	if wrap.Logger == nil {
+		log.Printf(fmt, args...)
+		return
+	}
+	wrap.Logger.Printf(fmt, args...)
+}
@@ -0,0 +1,48 @@
+package blitz
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestEventLevel(t *testing.T) {
+	tests := []struct {
+		name string
+		e    event
+		want slog.Level
+	}{
+		{"forward", event{Name: eventForward}, slog.LevelDebug},
+		{"forward observed", event{Name: eventForward, Observe: true}, slog.LevelInfo},
+		{"reserve", event{Name: eventReserve}, slog.LevelDebug},
+		{"reject", event{Name: eventReject}, slog.LevelInfo},
+		{"bad reservation", event{Name: eventBadReservation, Err: errors.New("bad")}, slog.LevelWarn},
+		{"store failed", event{Name: eventStoreFailed, Err: errors.New("failed")}, slog.LevelError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.e.level(); got != tt.want {
+				t.Errorf("level() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogEventObserveOnly(t *testing.T) {
+	for _, tt := range []struct {
+		observe bool
+		want    int
+	}{
+		{false, 0},
+		{true, 1},
+	} {
+		var logs bytes.Buffer
+		blitz := newTestBlitz(t, WithObserveOnly(tt.observe), WithSlogLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))))
+
+		sendRequest(t, blitz, nil)
+		if got := bytes.Count(logs.Bytes(), []byte("\n")); got != tt.want {
+			t.Errorf("observe only %t: logged %d records at info level, want %d: %q", tt.observe, got, tt.want, logs.String())
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package blitz
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// counters holds monotonic counters for a single queue.
+type counters struct {
+	forwarded atomic.Uint64 // requests forwarded to the handler
+	rejected  atomic.Uint64 // requests rejected because of an infinite delay
+	issued    atomic.Uint64 // reservations issued
+	used      atomic.Uint64 // reservations used
+	abandoned atomic.Uint64 // reservations cancelled because they were not confirmed in time
+	inflight  atomic.Int64  // requests currently being handled by the handler
+	waiting   atomic.Int64  // requests without a reservation currently waiting for their delay
+}
+
+// MetricsHandler returns a handler that exposes metrics in the Prometheus text format.
+// It is independent of the main handler, and may be mounted on a separate server.
+func (blitz *Blitz) MetricsHandler() http.Handler {
+	return http.HandlerFunc(blitz.serveMetrics)
+}
+
+func (blitz *Blitz) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buffer bytes.Buffer
+
+	writeMetricHeader(&buffer, "blitz_queue_tokens", "gauge", "Number of tokens currently available in the queue.")
+	now := blitz.clock.Now()
+	for i, l := range blitz.limiters {
+		fmt.Fprintf(&buffer, "blitz_queue_tokens{queue=\"%d\"} %g\n", i, l.TokensAt(now))
+	}
+
+	writeMetricHeader(&buffer, "blitz_queue_delay_milliseconds", "gauge", "Average delay received by clients of the queue in milliseconds.")
+	for i, s := range blitz.stats {
+		average, _ := s.Average().Float64()
+		fmt.Fprintf(&buffer, "blitz_queue_delay_milliseconds{queue=\"%d\"} %g\n", i, average/float64(time.Millisecond))
+	}
+
+	writeMetricHeader(&buffer, "blitz_series_average", "gauge", "Average of each registered series in the queue.")
+	for _, series := range blitz.allSeries() {
+		for i, s := range series.stats {
+			average, _ := s.Average().Float64()
+			fmt.Fprintf(&buffer, "blitz_series_average{series=\"%s\",queue=\"%d\"} %g\n", series.name, i, average)
+		}
+	}
+
+	writeMetricCounters(&buffer, blitz.counters, "blitz_forwarded_total", "Number of requests forwarded without a reservation.", func(c *counters) uint64 { return c.forwarded.Load() })
+	writeMetricCounters(&buffer, blitz.counters, "blitz_rejected_total", "Number of requests rejected because of an infinite delay.", func(c *counters) uint64 { return c.rejected.Load() })
+	writeMetricCounters(&buffer, blitz.counters, "blitz_reservations_issued_total", "Number of reservations issued.", func(c *counters) uint64 { return c.issued.Load() })
+	writeMetricCounters(&buffer, blitz.counters, "blitz_reservations_abandoned_total", "Number of reservations cancelled because they were not confirmed in time.", func(c *counters) uint64 { return c.abandoned.Load() })
+	writeMetricCounters(&buffer, blitz.counters, "blitz_reservations_used_total", "Number of requests forwarded using a reservation.", func(c *counters) uint64 { return c.used.Load() })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
+
+// writeMetricHeader writes the help and type lines of a metric.
+func writeMetricHeader(buffer *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", name, typ)
+}
+
+// writeMetricCounters writes a counter metric labeled by queue.
+func writeMetricCounters(buffer *bytes.Buffer, cs []counters, name, help string, get func(c *counters) uint64) {
+	writeMetricHeader(buffer, name, "counter", help)
+	for i := range cs {
+		fmt.Fprintf(buffer, "%s{queue=\"%d\"} %d\n", name, i, get(&cs[i]))
+	}
+}
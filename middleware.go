@@ -0,0 +1,36 @@
+package blitz
+
+import (
+	"context"
+	"net/http"
+)
+
+// Middleware creates a new server using the given options, see [NewWithOptions].
+// It returns a middleware wrapping handlers with it, for use in middleware chains such as the ones of chi or gorilla.
+//
+// All handlers wrapped by the same middleware share the queues of the server.
+// To use separate queues for different handlers, call Middleware once for each of them.
+func Middleware(opts ...Option) (func(http.Handler) http.Handler, error) {
+	blitz, err := NewWithOptions(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return blitz.Middleware, nil
+}
+
+// Middleware returns a handler admitting requests like this server, but forwarding them to next instead of [Blitz.Handler].
+// Requests to the control path are served as usual.
+func (blitz *Blitz) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blitz.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nextContextKey, next)))
+	})
+}
+
+// next returns the handler to forward the given request to.
+// It is the handler passed to [Blitz.Middleware], if any, and [Blitz.Handler] otherwise.
+func (blitz *Blitz) next(r *http.Request) http.Handler {
+	if next, ok := r.Context().Value(nextContextKey).(http.Handler); ok {
+		return next
+	}
+	return blitz.Handler
+}
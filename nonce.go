@@ -0,0 +1,69 @@
+package blitz
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NonceStore records the nonces of used reservation tokens.
+// It enables single-use reservations, see [WithNonceStore].
+//
+// Implementations must be safe for concurrent use.
+type NonceStore interface {
+	// Use marks the given nonce as used until the given time.
+	// It returns false if the nonce has already been used.
+	Use(ctx context.Context, nonce []byte, until time.Time) (bool, error)
+}
+
+// MemoryNonceStore is a [NonceStore] that keeps nonces in memory.
+// Nonces are forgotten once they expire.
+//
+// The zero value is ready to use.
+type MemoryNonceStore struct {
+	// Clock tells the time nonces are compared to when they expire.
+	// If nil, [NewWithOptions] sets it to the clock of the server, see [WithClock].
+	// Outside of a server, nil uses the system time.
+	Clock Clock
+
+	m         sync.Mutex
+	lastPurge time.Time
+	nonces    map[string]time.Time // nonces and the time they expire
+}
+
+// Use implements [NonceStore].
+func (store *MemoryNonceStore) Use(ctx context.Context, nonce []byte, until time.Time) (bool, error) {
+	store.m.Lock()
+	defer store.m.Unlock()
+
+	now := time.Now()
+	if store.Clock != nil {
+		now = store.Clock.Now()
+	}
+	if store.nonces == nil {
+		store.nonces = make(map[string]time.Time)
+	}
+
+	// check if the nonce is still in use
+	if expiry, ok := store.nonces[string(nonce)]; ok && now.Before(expiry) {
+		return false, nil
+	}
+	store.nonces[string(nonce)] = until
+
+	// forget expired nonces every once in a while
+	if now.Sub(store.lastPurge) > time.Second {
+		store.purge(now)
+	}
+
+	return true, nil
+}
+
+// purge removes all nonces expired at the given time.
+func (store *MemoryNonceStore) purge(now time.Time) {
+	store.lastPurge = now
+	for nonce, expiry := range store.nonces {
+		if !now.Before(expiry) {
+			delete(store.nonces, nonce)
+		}
+	}
+}
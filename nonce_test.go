@@ -0,0 +1,35 @@
+package blitz
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryNonceStoreClock(t *testing.T) {
+	clock := newFakeClock()
+	store := &MemoryNonceStore{}
+	newTestBlitz(t, WithClock(clock), WithNonceStore(store))
+	if store.Clock == nil {
+		t.Fatal("Clock = nil, want the clock of the server")
+	}
+
+	nonce := []byte("nonce")
+	until := clock.Now().Add(time.Second)
+	for _, tt := range []struct {
+		name    string
+		advance time.Duration
+		want    bool
+	}{
+		{"first use", 0, true},
+		{"reuse", 0, false},
+		{"reuse before expiry", time.Second / 2, false},
+		{"use after expiry", time.Second / 2, true},
+	} {
+		clock.Advance(tt.advance)
+		got, err := store.Use(context.Background(), nonce, until)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: Use() = %v, %v, want %v, nil", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,581 @@
+package blitz
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"net/netip"
+	"time"
+)
+
+// Option configures a [Blitz] when passed to [NewWithOptions].
+type Option func(blitz *Blitz)
+
+// WithRand sets the source of randomness used to generate the signing keypair, the nonces of reservations and jitter, see [WithJitter].
+// It is read while serving requests, but need not be safe for concurrent use: unless it is [crypto/rand.Reader], reads are serialized.
+func WithRand(rand io.Reader) Option {
+	return func(blitz *Blitz) {
+		blitz.rand = rand
+	}
+}
+
+// WithRefill sets how often queues refill, unless they specify their own duration.
+// It must be positive, and defaults to one second.
+func WithRefill(every time.Duration) Option {
+	return func(blitz *Blitz) {
+		blitz.every = every
+	}
+}
+
+// WithQueues sets the burst of each queue.
+// Queues with a higher index are considered to be of higher priority.
+func WithQueues(bs []uint64) Option {
+	return func(blitz *Blitz) {
+		blitz.queues = make([]QueueConfig, len(bs))
+		for i, b := range bs {
+			blitz.queues[i].Rate = b
+		}
+	}
+}
+
+// WithQueueConfigs is like [WithQueues], but allows configuring each queue individually.
+func WithQueueConfigs(queues []QueueConfig) Option {
+	return func(blitz *Blitz) {
+		blitz.queues = append([]QueueConfig(nil), queues...)
+	}
+}
+
+// WithLogger sets the logger used by the server.
+// See also [WithSlogLogger].
+func WithLogger(logger *log.Logger) Option {
+	return func(blitz *Blitz) {
+		blitz.Logger = logger
+	}
+}
+
+// WithLogLevel sets the minimum level of events logged using the logger set by [WithLogger].
+// Reserved and forwarded requests are logged at [slog.LevelDebug], rejected requests at [slog.LevelInfo], and invalid reservations at [slog.LevelWarn].
+// In observe mode, see [WithObserveOnly], forwarded requests are logged at [slog.LevelInfo] as well.
+func WithLogLevel(level slog.Level) Option {
+	return func(blitz *Blitz) {
+		blitz.LogLevel = level
+	}
+}
+
+// WithSlogLogger sets a logger used to emit structured log records.
+// It takes precedence over a logger set using [WithLogger].
+func WithSlogLogger(logger *slog.Logger) Option {
+	return func(blitz *Blitz) {
+		blitz.SlogLogger = logger
+	}
+}
+
+// WithControlPath sets the path of the status and reservation endpoint, defaulting to [DefaultControlPath].
+// The path must start and end with a slash.
+func WithControlPath(path string) Option {
+	return func(blitz *Blitz) {
+		blitz.control = path
+	}
+}
+
+// WithRejectStatus sets the status code sent to clients whose request can not be admitted, defaulting to [DefaultRejectStatus].
+// Some deployments may prefer [net/http.StatusBadGateway] for gateway semantics.
+func WithRejectStatus(status int) Option {
+	return func(blitz *Blitz) {
+		blitz.reject = status
+	}
+}
+
+// WithCancelStatus sets the status code recorded for requests cancelled by the client while waiting, defaulting to [DefaultCancelStatus].
+// As the client is gone, it is only visible in logs and metrics of the server, and should be distinct from genuine gateway errors.
+func WithCancelStatus(status int) Option {
+	return func(blitz *Blitz) {
+		blitz.cancel = status
+	}
+}
+
+// WithNonceStore enables single-use reservations, recording used reservation tokens in the given store.
+// A reservation token presented more than once is rejected.
+//
+// Use a [MemoryNonceStore] for a single instance, or a shared store for multiple instances.
+func WithNonceStore(store NonceStore) Option {
+	return func(blitz *Blitz) {
+		blitz.nonces = store
+	}
+}
+
+// WithKeyFile persists the keypair used to sign reservations in the file at path.
+// If the file does not exist, a new keypair is generated and saved with permissions only allowing access by the current user.
+//
+// This allows reservations to remain valid across restarts, and to be shared between several instances.
+func WithKeyFile(path string) Option {
+	return func(blitz *Blitz) {
+		blitz.keyFile = path
+	}
+}
+
+// WithStatsCapacity limits the number of delays held by the statistics of each queue.
+// Once reached, the oldest delay is discarded.
+// This bounds memory usage under heavy traffic, at the cost of accuracy.
+func WithStatsCapacity(capacity int) Option {
+	return func(blitz *Blitz) {
+		blitz.statsCapacity = capacity
+	}
+}
+
+// WithStatsWindow sets the duration the statistics of each queue are held for, such as the average delay reported by [Blitz.Status].
+// By default, it is ten times the refill duration of the queue.
+func WithStatsWindow(d time.Duration) Option {
+	return func(blitz *Blitz) {
+		blitz.statsWindow = d
+	}
+}
+
+// WithQueueSelector sets the selector used to pick the queue of each request.
+// By default, the queue is selected like [SelectQueueHeader], but the header may also contain the name of a queue.
+func WithQueueSelector(selector QueueSelector) Option {
+	return func(blitz *Blitz) {
+		blitz.selector = selector
+		blitz.customSelector = true
+	}
+}
+
+// WithCostFunc sets the function used to compute the cost of each request, that is the number of slots it uses up.
+// By default, every request costs one slot.
+// The limits of each client set using [WithPerClientLimit] are not affected by the cost.
+func WithCostFunc(cost CostFunc) Option {
+	return func(blitz *Blitz) {
+		blitz.cost = cost
+	}
+}
+
+// WithPerClientLimit additionally limits the rate of each client, identified by address, across all queues.
+// The limiter of each client refills every given duration, and admits at most burst requests at once.
+//
+// Clients that have been idle for the given ttl are forgotten.
+// A zero ttl uses the time it takes for the limiter of a client to fully refill.
+func WithPerClientLimit(every time.Duration, burst int, ttl time.Duration) Option {
+	return func(blitz *Blitz) {
+		if ttl <= 0 {
+			ttl = max(every*time.Duration(burst), every)
+		}
+		blitz.clients = newClientLimiters(every, burst, ttl)
+	}
+}
+
+// WithTrustProxy sets if clients are identified using the X-Forwarded-For header of every request.
+// This should only be enabled when blitz is only reachable via a trusted proxy.
+// Otherwise, use [WithTrustedProxies] instead.
+func WithTrustProxy(trust bool) Option {
+	return func(blitz *Blitz) {
+		blitz.trustProxy = trust
+	}
+}
+
+// WithTrustedProxies identifies clients using the X-Forwarded-For header of requests coming from the given proxies.
+// The client is the rightmost entry of the header that does not belong to a trusted proxy, see also [WithForwardedFirst].
+// Requests from other addresses are identified by their remote address.
+func WithTrustedProxies(prefixes []netip.Prefix) Option {
+	return func(blitz *Blitz) {
+		blitz.trustedProxies = append(blitz.trustedProxies, prefixes...)
+	}
+}
+
+// WithForwardedFirst sets if clients are identified using the first entry of a trusted X-Forwarded-For header.
+// This is only safe if the outermost trusted proxy discards the header sent by clients.
+func WithForwardedFirst(first bool) Option {
+	return func(blitz *Blitz) {
+		blitz.forwardedFirst = first
+	}
+}
+
+// WithReservationQuery additionally accepts reservations passed in the query parameter with the given name.
+// The [HeaderReservation] header takes precedence, and the parameter is removed before forwarding.
+func WithReservationQuery(name string) Option {
+	return func(blitz *Blitz) {
+		blitz.reservationQuery = name
+	}
+}
+
+// WithReservationCookie additionally accepts reservations passed in the cookie with the given name.
+// The [HeaderReservation] header and the query parameter take precedence, and the cookie is removed before forwarding.
+func WithReservationCookie(name string) Option {
+	return func(blitz *Blitz) {
+		blitz.reservationCookie = name
+	}
+}
+
+// WithForwardHeaders sets if forwarded requests carry the [HeaderQueue] and [HeaderWaited] headers.
+// These tell the handler about the queue the request was admitted into, and how long it waited in milliseconds.
+//
+// Regardless of this option, the handler can use [QueueFromContext] and [DelayFromContext].
+func WithForwardHeaders(forward bool) Option {
+	return func(blitz *Blitz) {
+		blitz.forwardHeaders = forward
+	}
+}
+
+// WithForwardExpiresHeader sets if requests using a reservation are forwarded with the [HeaderTokenExpires] header.
+// It holds the time the reservation expires as a unix timestamp in milliseconds.
+// This allows the handler to know how much of the window of the reservation remains.
+//
+// Regardless of this option, the handler can use [ExpiresFromContext].
+func WithForwardExpiresHeader(forward bool) Option {
+	return func(blitz *Blitz) {
+		blitz.forwardExpires = forward
+	}
+}
+
+// WithForwardQueueHeader is like [WithForwardHeaders], but only sets the [HeaderQueue] header.
+// The header sent by the client is replaced with the index of the queue the request was actually admitted into.
+//
+// The [HeaderReservation] header is never forwarded, regardless of these options.
+func WithForwardQueueHeader(forward bool) Option {
+	return func(blitz *Blitz) {
+		blitz.forwardQueue = forward
+	}
+}
+
+// WithClockSkew sets the tolerance when checking if a reservation is valid, defaulting to [DefaultClockSkew].
+// Reservations are accepted the given duration before they become valid, and the given duration after they expire.
+// This accounts for clock skew of clients and network latency.
+func WithClockSkew(skew time.Duration) Option {
+	return func(blitz *Blitz) {
+		blitz.skew = skew
+	}
+}
+
+// WithMaxReservationDelay sets the maximum delay of a reservation.
+// If a reservation would have a longer delay, it is not made, and the client is told to try again later instead.
+// A zero duration means unlimited.
+func WithMaxReservationDelay(d time.Duration) Option {
+	return func(blitz *Blitz) {
+		blitz.maxReservationDelay = d
+	}
+}
+
+// WithVerifyKey additionally accepts reservations signed with the private key belonging to the given public key.
+// New reservations are still signed with the keypair of the server.
+//
+// This allows rotating keys without invalidating reservations signed with a previous key.
+func WithVerifyKey(pub [32]byte) Option {
+	return func(blitz *Blitz) {
+		blitz.verifyKeys = append(blitz.verifyKeys, pub)
+	}
+}
+
+// WithVerifyKeyFile is like [WithVerifyKey], but reads the public key from a key file created by [WithKeyFile].
+func WithVerifyKeyFile(path string) Option {
+	return func(blitz *Blitz) {
+		blitz.verifyKeyFiles = append(blitz.verifyKeyFiles, path)
+	}
+}
+
+// WithHMACKey signs reservations using HMAC-SHA256 with the given shared secret instead of a nacl keypair.
+// This produces considerably shorter reservations, but anyone who knows the key can create them.
+// The key must be at least 16 bytes long, and can not be combined with [WithKeyFile] or [WithVerifyKey].
+func WithHMACKey(key []byte) Option {
+	return func(blitz *Blitz) {
+		blitz.hmacKey = key
+	}
+}
+
+// WithHMACTagLength sets the length in bytes that HMAC tags are truncated to, see [WithHMACKey].
+// It must be between 10 and 32, and defaults to [DefaultHMACTagLength].
+func WithHMACTagLength(length int) Option {
+	return func(blitz *Blitz) {
+		blitz.hmacTagLength = length
+	}
+}
+
+// WithMaxWaiters limits the number of requests that wait for their delay at once.
+// Once reached, requests that would have to wait are rejected with [net/http.StatusServiceUnavailable] instead.
+// This protects the server from exhausting memory and connections during a spike of traffic.
+// A limit of zero means unlimited.
+func WithMaxWaiters(n int) Option {
+	return func(blitz *Blitz) {
+		blitz.maxWaiters = n
+	}
+}
+
+// WithSeparateControl sets if the status and reservation endpoint is only served by [Blitz.ControlHandler].
+// Then all requests passed to [Blitz.ServeHTTP] are treated as requests to proxy, including those to the control path.
+func WithSeparateControl(separate bool) Option {
+	return func(blitz *Blitz) {
+		blitz.separateControl = separate
+	}
+}
+
+// WithJitter adds a random duration to each non-zero delay, of at most the given fraction of the refill duration of the queue.
+// The fraction must be between 0 and 1, and defaults to 0.
+// For example, a fraction of 0.1 adds up to 100ms to delays in a queue refilling every second.
+// This avoids many waiting requests being forwarded at the same time when a queue refills.
+//
+// For reservations, the jitter is included in the time they become valid.
+// Random durations are read from the source of randomness, see [WithRand].
+func WithJitter(fraction float64) Option {
+	return func(blitz *Blitz) {
+		blitz.jitter = fraction
+	}
+}
+
+// WithTracerProvider traces requests using a tracer obtained from the given provider.
+// A span covers the time a request waits to be admitted, or a reservation is made.
+// It records the queue and delay of the request, or if it was rejected.
+//
+// If propagator is non-nil, the trace context of clients is continued, and passed on to the handler.
+func WithTracerProvider(tp TracerProvider, propagator Propagator) Option {
+	return func(blitz *Blitz) {
+		blitz.tracer = tp.Tracer(tracerName)
+		blitz.propagator = propagator
+	}
+}
+
+// WithUpgradeQueue admits requests upgrading the connection, such as WebSockets, into the queue with the given index.
+// This allows limiting the rate of new long-lived connections separately from regular requests.
+// A negative index selects the queue of such requests like for any other request, which is the default.
+//
+// Once forwarded, an upgraded connection is not affected by timers of blitz.
+// However, [Blitz.Shutdown] waits for it to be closed.
+func WithUpgradeQueue(queue int) Option {
+	return func(blitz *Blitz) {
+		blitz.upgradeQueue = queue
+	}
+}
+
+// WithUpgradeBypass sets if requests upgrading the connection, such as WebSockets, are forwarded immediately.
+// Such requests neither wait nor use up slots of any queue.
+func WithUpgradeBypass(bypass bool) Option {
+	return func(blitz *Blitz) {
+		blitz.upgradeBypass = bypass
+	}
+}
+
+// WithBindRequest sets if reservations are bound to the method and path of a single request.
+// Then clients must declare the request when making a reservation, using the [HeaderBindMethod] and [HeaderBindPath] headers,
+// or the "method" and "path" query parameters.
+// The reservation can then only be used for a request with the same method and path.
+//
+// This prevents using a reservation made for a cheap request for an expensive one.
+func WithBindRequest(bind bool) Option {
+	return func(blitz *Blitz) {
+		blitz.bindRequest = bind
+	}
+}
+
+// WithObserveOnly sets if requests are only observed, rather than limited.
+// Delays and rejections are computed, logged and recorded in statistics and metrics as usual,
+// but every request without a reservation is forwarded immediately.
+//
+// This allows measuring the effect of queue rates on production traffic before enforcing them.
+func WithObserveOnly(observe bool) Option {
+	return func(blitz *Blitz) {
+		blitz.observeOnly = observe
+	}
+}
+
+// WithReservationConfirm requires reservations to be confirmed within the given grace period.
+// A reservation is confirmed by posting it to the "confirm" endpoint below the control path, or by using it.
+// Reservations not confirmed in time are cancelled, returning their slots to the queue, and can no longer be used.
+//
+// By default, reservations need not be confirmed, and the slots of abandoned reservations are lost.
+// As confirmations are kept in memory, reservations can then only be used with the instance that issued them.
+// At most [DefaultMaxPendingConfirmations] reservations wait to be confirmed at once, see [WithMaxPendingConfirmations].
+func WithReservationConfirm(grace time.Duration) Option {
+	return func(blitz *Blitz) {
+		blitz.confirmGrace = grace
+	}
+}
+
+// WithMaxPendingConfirmations limits the number of reservations waiting to be confirmed at once, see [WithReservationConfirm].
+// Reservations are kept until they expire, even once confirmed, so that using them can be checked.
+// Once reached, further reservation requests fail with a code of [CodeRateLimited], telling the client to retry after the grace period.
+// A limit of zero uses [DefaultMaxPendingConfirmations].
+func WithMaxPendingConfirmations(n int) Option {
+	return func(blitz *Blitz) {
+		blitz.maxPending = n
+	}
+}
+
+// WithPerQueueKeys sets if reservations of each queue are signed with a separate key.
+// The key of each queue is derived from the configured key using HKDF, see [WithKeyFile] and [WithHMACKey].
+// A reservation signed with the key of one queue is not accepted for any other queue.
+//
+// This isolates queues used by different tenants: a leaked key of one queue can not be used to create reservations for another.
+// It can not be combined with [WithVerifyKey].
+func WithPerQueueKeys(perQueue bool) Option {
+	return func(blitz *Blitz) {
+		blitz.perQueueKeys = perQueue
+	}
+}
+
+// WithMaxHold sets the maximum duration a request without a reservation is held for.
+// Requests with a longer delay are rejected immediately with [net/http.StatusTooManyRequests],
+// along with a Retry-After header telling the client when the delay would be short enough.
+// A zero duration means unlimited.
+//
+// Unlike [WithMaxReservationDelay], this only affects requests waiting for their delay, not reservations.
+func WithMaxHold(d time.Duration) Option {
+	return func(blitz *Blitz) {
+		blitz.maxHold = d
+	}
+}
+
+// WithClock sets the clock used to tell the time, defaulting to the system time.
+// It is used for delays, the validity of reservations and statistics, allowing tests to control the passing of time.
+//
+// Per-client limits and a [MemoryNonceStore] use it as well, timers of confirmations always use the system time.
+//
+// If the clock steps backward, the server logs a warning and holds the latest time it has seen until the clock catches up.
+// This keeps delays and statistics consistent, but freezes them for the duration of the step.
+func WithClock(clock Clock) Option {
+	return func(blitz *Blitz) {
+		blitz.clock = clock
+	}
+}
+
+// WithGlobalRate additionally limits the rate of requests across all queues to rps requests per second, admitting at most burst at once.
+// Every request admitted into any queue, with or without a reservation, also has to pass the global limiter.
+// Requests wait until both their queue and the global limiter admit them, and are rejected if the global limiter never can.
+//
+// This caps the load on the backend, even if the rates of all queues add up to more than it can handle.
+func WithGlobalRate(rps float64, burst int) Option {
+	return func(blitz *Blitz) {
+		blitz.globalRate = rps
+		blitz.globalBurst = burst
+	}
+}
+
+// WithStrictQueueHeader sets if requests with an invalid [HeaderQueue] header are rejected with [net/http.StatusBadRequest].
+// A header is invalid if it is empty, malformed, or does not name or index an existing queue.
+// Requests without the header still use queue 0.
+//
+// By default, requests with an invalid header silently use queue 0, unless it is the index of a queue that does not exist, which is always rejected.
+// This has no effect when a custom [QueueSelector] is set.
+func WithStrictQueueHeader(strict bool) Option {
+	return func(blitz *Blitz) {
+		blitz.strictQueueHeader = strict
+	}
+}
+
+// WithReservationRate limits the rate of requests to the reservation endpoint to rps per second, allowing at most burst at once.
+// Requests exceeding it are rejected with [net/http.StatusTooManyRequests] and the [CodeRateLimited] code, before a reservation is made or signed.
+//
+// This protects the control endpoint from clients making excessive reservations, independently of the rates of the queues.
+func WithReservationRate(rps float64, burst int) Option {
+	return func(blitz *Blitz) {
+		blitz.reserveRate = rps
+		blitz.reserveBurst = burst
+	}
+}
+
+// WithForwardClientHeaders sets if forwarded requests carry X-Forwarded-For and [HeaderRealIP] headers identifying the client.
+// The client is identified like for logging and per-client limits, see [WithTrustProxy] and [WithTrustedProxies].
+//
+// The X-Real-IP header is set to the address of the client.
+// The X-Forwarded-For header only keeps the trusted entries, starting at the client, and is removed if it is not trusted.
+// The handler is expected to append the remote address of the request, as [net/http/httputil.ReverseProxy] does.
+func WithForwardClientHeaders(forward bool) Option {
+	return func(blitz *Blitz) {
+		blitz.forwardClient = forward
+	}
+}
+
+// WithVerifyCache caches up to size verified reservations, so that reservations used repeatedly have their signature checked only once.
+// Each reservation is cached until it expires, and the cache does not grow once full.
+// A size of zero, the default, verifies the signature of every use.
+//
+// This saves work when reservations are used for many requests, see [HeaderCount].
+// It does not affect any other check, so single-use reservations are still rejected when used again.
+func WithVerifyCache(size int) Option {
+	return func(blitz *Blitz) {
+		blitz.verifyCache = size
+	}
+}
+
+// WithRandomDowngrade sets if requests that the requested queue can not admit immediately are admitted into a randomly picked queue.
+// Among the requested queue and all lower ones, each queue is picked with a probability inversely proportional to its delay
+// plus the time it takes one of its slots to refill.
+//
+// By default, the queue with the lowest delay is picked, which can completely drain lower queues when a higher one is saturated.
+// Picking randomly instead leaves some capacity in each of them.
+// This has no effect if any queue has a weight, see [QueueConfig.Weight].
+func WithRandomDowngrade(random bool) Option {
+	return func(blitz *Blitz) {
+		blitz.randomDowngrade = random
+	}
+}
+
+// WithValidFromSlack makes reservations issued without a delay valid from the given duration before they were issued.
+// This guarantees that they are usable immediately, even if validity is checked without tolerating clock skew, see [WithClockSkew].
+// It defaults to zero, and does not affect the recommended time to send the request or the expiry of the reservation.
+func WithValidFromSlack(slack time.Duration) Option {
+	return func(blitz *Blitz) {
+		blitz.validFromSlack = slack
+	}
+}
+
+// WithSigner signs reservations using the given signer, rather than a private key held in memory.
+// Reservations are verified locally using its public key, which is also served like any other, see [Blitz.PublicKey].
+// It can not be combined with [WithKeyFile], [WithHMACKey] or [WithPerQueueKeys], but with [WithVerifyKey].
+//
+// Signing a reservation times out after [DefaultSignTimeout].
+// If the signer fails, the reservation endpoint responds with [net/http.StatusInternalServerError],
+// while requests without a reservation are still admitted as usual.
+func WithSigner(s Signer) Option {
+	return func(blitz *Blitz) {
+		blitz.remoteSigner = s
+	}
+}
+
+// WithCORS allows browsers to make requests to the control endpoint from the given origins, such as "https://dashboard.example.com".
+// Responses to requests from these origins carry the appropriate Access-Control headers, and preflight requests are answered.
+// Requests proxied to the handler are never affected.
+//
+// The origin "*" allows any origin.
+// This is discouraged, as it allows any website visited by an operator to read the status, and to make reservations in their name.
+func WithCORS(origins []string) Option {
+	return func(blitz *Blitz) {
+		blitz.corsOrigins = append([]string(nil), origins...)
+	}
+}
+
+// WithBorrowDepth limits the number of lower queues a request may be admitted into to depth.
+// For example, with a depth of 2, a request for queue 10 is admitted into queue 8, 9 or 10.
+// It defaults to zero, which allows all lower queues.
+//
+// Admitting a request makes a reservation on every queue it may be admitted into, so that the one with the lowest delay can be picked.
+// With many queues, limiting the depth bounds this cost.
+func WithBorrowDepth(depth int) Option {
+	return func(blitz *Blitz) {
+		blitz.borrowDepth = depth
+	}
+}
+
+// WithReservationTTL sets the duration reservations are valid for, starting at the time they were issued for.
+// It defaults to zero, which uses the refill duration of the queue of the reservation.
+//
+// A longer duration gives clients more slack to use a reservation, without having to make a new one.
+// However, the slot of a reservation is used up when it is issued, no matter when it is used.
+// So clients using reservations late may send more requests at once than the rate of the queue:
+// up to the rate times the duration, in addition to the burst.
+func WithReservationTTL(d time.Duration) Option {
+	return func(blitz *Blitz) {
+		blitz.reservationTTL = d
+	}
+}
+
+// WithFailMode sets how requests are handled when an internal error prevents deciding on them, defaulting to [FailClosed].
+// Each such decision is logged along with the error.
+//
+// When a reservation can not be signed, failing closed responds with [net/http.StatusInternalServerError].
+// Failing open instead tells the client to send its request right away without a reservation, where it is admitted as usual.
+// The reservation is then successful, but has a code of [CodeUnsigned] and no token.
+//
+// When the nonce store fails, see [WithNonceStore], failing closed rejects the request with [net/http.StatusServiceUnavailable].
+// Failing open lets the request through if its reservation is valid otherwise, even though it may have been used before.
+func WithFailMode(mode FailMode) Option {
+	return func(blitz *Blitz) {
+		blitz.failMode = mode
+	}
+}
@@ -0,0 +1,35 @@
+package blitz
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the version of the json format of responses from the control endpoint.
+// It is sent with every such response in the [HeaderProtocol] header, and increased whenever the format changes incompatibly.
+const ProtocolVersion = 1
+
+// HeaderProtocol is the header holding the protocol version.
+//
+// Clients may send it with the comma-separated versions they understand.
+// If the server supports none of them, the request is rejected with [net/http.StatusNotAcceptable].
+const HeaderProtocol = "X-Blitz-Protocol"
+
+// acceptsProtocol checks if the client making the given request understands the current protocol version.
+// Clients that do not send the [HeaderProtocol] header are assumed to.
+func acceptsProtocol(r *http.Request) bool {
+	values := r.Header.Values(HeaderProtocol)
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, value := range values {
+		for _, version := range strings.Split(value, ",") {
+			if v, err := strconv.Atoi(strings.TrimSpace(version)); err == nil && v == ProtocolVersion {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package blitz
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// QueueConfig configures a single queue.
+type QueueConfig struct {
+	// Rate is the number of requests admitted every refill duration.
+	// Unless Burst is set, it is also the burst of the queue.
+	//
+	// A rate of zero makes the queue closed: it never admits requests itself.
+	// Requests for a closed queue are admitted into a lower queue if possible, and rejected otherwise.
+	Rate uint64
+
+	// Burst is the maximum number of requests admitted at once, that is the number of slots a queue holds when fully refilled.
+	// When zero, Rate is used.
+	//
+	// A burst larger than the rate allows short spikes above the steady rate.
+	// For example, a Rate of 10 and a Burst of 50 admits 10 requests per refill duration on average, but up to 50 at once after being idle.
+	Burst uint64
+
+	// Every is the refill duration of the queue, that is the duration over which Rate requests are admitted.
+	// Slots refill continuously, one every Every / Rate.
+	// For example, a Rate of 100 and an Every of one minute admits 100 requests per minute.
+	//
+	// When zero, the refill duration of the server is used, see [WithRefill].
+	Every time.Duration
+
+	// Weight is the share of this queue when lending slots to higher-priority queues.
+	// If any queue has a non-zero weight, slots are lent proportionally to the weights, and queues with zero weight never lend slots.
+	//
+	// A higher queue that can not admit a request right away borrows from the lower queue i with a lower delay
+	// and the lowest ratio borrowed[i] / Weight[i], where borrowed[i] is the number of slots queue i lent so far.
+	// So while higher queues are saturated and the lenders have slots, queue i lends Weight[i] / (sum of the weights of the lenders) of the borrowed slots.
+	// For example, lenders with weights 1 and 3 lend 25% and 75% of the borrowed slots.
+	Weight uint64
+
+	// MaxConcurrent is the maximum number of requests of this queue handled at once, zero for unlimited.
+	// Once reached, admitted requests wait until an earlier one completes, or their context is done.
+	//
+	// This complements the rate, for backends limited by the number of requests in flight rather than the number of requests per second.
+	// Requests upgrading the connection count until the upgraded connection is closed.
+	MaxConcurrent uint64
+
+	// MaxQueueLength is the maximum number of requests without a reservation waiting for their delay in this queue at once, zero for unlimited.
+	// Once reached, further requests admitted into this queue are rejected immediately with [net/http.StatusServiceUnavailable].
+	//
+	// This sheds load under overload, keeping the delay of admitted requests bounded rather than admitting everything.
+	MaxQueueLength uint64
+
+	// Name is an optional human-readable name of the queue, such as "anonymous" or "crawler".
+	// It is included in logs and the status, and clients may pass it in the [HeaderQueue] header instead of the index.
+	// Names must be unique, and must not be integers.
+	Name string
+}
+
+// limit returns the rate at which slots of the queue refill, in slots per second.
+func (q QueueConfig) limit() rate.Limit {
+	if q.Rate == 0 {
+		return 0
+	}
+	return rate.Limit(float64(q.Rate) / q.Every.Seconds())
+}
+
+// burst returns the burst of the limiter of the queue, which is zero for closed queues.
+func (q QueueConfig) burst() int {
+	switch {
+	case q.Rate == 0:
+		return 0
+	case q.Burst == 0:
+		return int(q.Rate)
+	default:
+		return int(q.Burst)
+	}
+}
+
+// QueueSelector selects the index of the queue to admit a request into.
+// An index that is out of bounds selects queue 0.
+//
+// A selector allows the operator, rather than the client, to control prioritization.
+// For example, it could select a low-priority queue for expensive paths, and a high-priority queue otherwise.
+type QueueSelector func(r *http.Request) int
+
+// SelectQueueHeader is the default [QueueSelector].
+// It selects the queue given in the [HeaderQueue] header, or 0 if no such header is present or it is of invalid format.
+func SelectQueueHeader(r *http.Request) int {
+	header := r.Header.Get(HeaderQueue)
+	value, err := strconv.ParseInt(header, 10, 0)
+	if err != nil {
+		return 0
+	}
+	return int(value)
+}
+
+// selectQueueName is the default [QueueSelector] used by a server.
+// It is like [SelectQueueHeader], but additionally accepts the name of a queue.
+func (blitz *Blitz) selectQueueName(r *http.Request) int {
+	if index, ok := blitz.queueNames[r.Header.Get(HeaderQueue)]; ok {
+		return index
+	}
+	return SelectQueueHeader(r)
+}
+
+var (
+	errMissingQueueHeader = errors.New("no queue given")
+	errInvalidQueueHeader = errors.New("queue must be the index or name of an existing queue")
+	errQueueOutOfRange    = errors.New("queue index is out of range")
+)
+
+// parseQueueHeader parses the [HeaderQueue] header of the given request into the index of a queue.
+// It accepts both the index and the name of a queue.
+//
+// If the header is missing, returns errMissingQueueHeader.
+// If it is an index, but no queue with that index exists, returns errQueueOutOfRange.
+// If it is empty, malformed or does not name an existing queue, returns errInvalidQueueHeader.
+func (blitz *Blitz) parseQueueHeader(r *http.Request) (int, error) {
+	values := r.Header.Values(HeaderQueue)
+	if len(values) == 0 {
+		return 0, errMissingQueueHeader
+	}
+
+	if index, ok := blitz.queueNames[values[0]]; ok {
+		return index, nil
+	}
+	value, err := strconv.ParseInt(values[0], 10, 0)
+	if err != nil {
+		return 0, errInvalidQueueHeader
+	}
+	if value < 0 || value >= int64(len(blitz.queues)) {
+		return 0, errQueueOutOfRange
+	}
+	return int(value), nil
+}
+
+// checkQueueHeader checks that the [HeaderQueue] header of the given request is valid, if it is present.
+// An index of a queue that does not exist is always rejected, as the client clearly asked for a queue that is not there.
+// Other invalid headers are only rejected if [WithStrictQueueHeader] is set.
+// When a custom selector is used, the header is not checked at all.
+func (blitz *Blitz) checkQueueHeader(r *http.Request) error {
+	if blitz.customSelector {
+		return nil
+	}
+	switch _, err := blitz.parseQueueHeader(r); {
+	case errors.Is(err, errQueueOutOfRange):
+		return err
+	case err != nil && err != errMissingQueueHeader && blitz.strictQueueHeader:
+		return err
+	}
+	return nil
+}
+
+// CostFunc computes the cost of a request, that is the number of slots it uses up.
+// Requests whose cost exceeds the rate of a queue can not be admitted into it.
+//
+// For example, a cost function could make large uploads cost more than small requests.
+type CostFunc func(r *http.Request) int
+
+// requestCost returns the cost of the given request, which is at least one.
+func (blitz *Blitz) requestCost(r *http.Request) int {
+	if blitz.cost == nil {
+		return 1
+	}
+	return max(blitz.cost(r), 1)
+}
+
+// claimedQueue returns the queue a request using a reservation claims, or -1 if it claims none.
+// A request claims a queue if a custom selector is used, or it passes the [HeaderQueue] header.
+func (blitz *Blitz) claimedQueue(r *http.Request) int {
+	if !blitz.customSelector && r.Header.Get(HeaderQueue) == "" {
+		return -1
+	}
+	return blitz.selectQueue(r)
+}
+
+// selectQueue returns the queue selected for the given request.
+// Requests upgrading the connection use the queue set by [WithUpgradeQueue], if any.
+// If in-bounds checking fails, returns 0.
+func (blitz *Blitz) selectQueue(r *http.Request) int {
+	if blitz.upgradeQueue >= 0 && isUpgrade(r) {
+		return blitz.upgradeQueue
+	}
+
+	queue := blitz.selector(r)
+	if queue < 0 || queue >= len(blitz.limiters) {
+		return 0
+	}
+	return queue
+}
+
+// errInvalidQueue indicates that the queue with the given index is configured incorrectly.
+type errInvalidQueue struct {
+	Index  int
+	Reason string
+}
+
+func (err errInvalidQueue) Error() string {
+	return fmt.Sprintf("invalid queue %d: %s", err.Index, err.Reason)
+}
+
+// validate checks that this configuration is valid for the queue with the given index.
+func (q QueueConfig) validate(index int) error {
+	if q.Rate > math.MaxInt {
+		return errInvalidQueue{Index: index, Reason: fmt.Sprintf("rate %d is too large", q.Rate)}
+	}
+	if q.Burst > math.MaxInt {
+		return errInvalidQueue{Index: index, Reason: fmt.Sprintf("burst %d is too large", q.Burst)}
+	}
+	if q.MaxConcurrent > math.MaxInt {
+		return errInvalidQueue{Index: index, Reason: fmt.Sprintf("maximum concurrency %d is too large", q.MaxConcurrent)}
+	}
+	if q.MaxQueueLength > math.MaxInt64 {
+		return errInvalidQueue{Index: index, Reason: fmt.Sprintf("maximum queue length %d is too large", q.MaxQueueLength)}
+	}
+	if q.Every < 0 {
+		return errInvalidQueue{Index: index, Reason: fmt.Sprintf("refill duration %s is negative", q.Every)}
+	}
+	if _, err := strconv.ParseInt(q.Name, 10, 0); err == nil {
+		return errInvalidQueue{Index: index, Reason: fmt.Sprintf("name %q is an integer", q.Name)}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package blitz
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseQueueHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string // values of the header, nil if absent
+
+		want    int
+		wantErr error
+	}{
+		{"missing", nil, 0, errMissingQueueHeader},
+		{"valid", []string{"1"}, 1, nil},
+		{"name", []string{"crawler"}, 2, nil},
+		{"empty", []string{""}, 0, errInvalidQueueHeader},
+		{"negative", []string{"-1"}, 0, errQueueOutOfRange},
+		{"overflow", []string{"99999999999999999999"}, 0, errInvalidQueueHeader},
+		{"out of range", []string{"3"}, 0, errQueueOutOfRange},
+		{"not a number", []string{"one"}, 0, errInvalidQueueHeader},
+		{"whitespace", []string{" 1"}, 0, errInvalidQueueHeader},
+		{"first value counts", []string{"1", "7"}, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blitz := newTestBlitz(t, WithQueueConfigs([]QueueConfig{{Rate: 1}, {Rate: 1}, {Rate: 1, Name: "crawler"}}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, value := range tt.values {
+				r.Header.Add(HeaderQueue, value)
+			}
+
+			got, err := blitz.parseQueueHeader(r)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("parseQueueHeader() = %d, %v, want %d, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStrictQueueHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+
+		wantLenient int // status without WithStrictQueueHeader
+		wantStrict  int // status with WithStrictQueueHeader
+	}{
+		{"valid", "1", http.StatusOK, http.StatusOK},
+		{"empty", "", http.StatusOK, http.StatusBadRequest},
+		{"negative", "-1", http.StatusBadRequest, http.StatusBadRequest},
+		{"overflow", "99999999999999999999", http.StatusOK, http.StatusBadRequest},
+		{"out of range", "2", http.StatusBadRequest, http.StatusBadRequest},
+		{"not a number", "one", http.StatusOK, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		for _, strict := range []bool{false, true} {
+			name := tt.name + "/lenient"
+			want := tt.wantLenient
+			if strict {
+				name = tt.name + "/strict"
+				want = tt.wantStrict
+			}
+
+			t.Run(name, func(t *testing.T) {
+				blitz := newTestBlitz(t, WithQueues([]uint64{1, 1}), WithStrictQueueHeader(strict))
+
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("Accept", "application/json")
+				r.Header[HeaderQueue] = []string{tt.value}
+				w := httptest.NewRecorder()
+				blitz.ServeHTTP(w, r)
+
+				if w.Code != want {
+					t.Errorf("status = %d, want %d", w.Code, want)
+				}
+			})
+		}
+	}
+}
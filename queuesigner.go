@@ -0,0 +1,108 @@
+package blitz
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var errPerQueueVerifyKeys = errors.New("per-queue keys can not be combined with verify keys")
+
+// queueSigner signs the tokens of each queue using a separate signer.
+// A token signed by the signer of one queue is not accepted for any other queue.
+type queueSigner struct {
+	signers []queueKeySigner // signer of each queue
+}
+
+// queueKeySigner is a signer that can be used for a single queue.
+type queueKeySigner interface {
+	signer
+
+	// unverifiedMessage returns the message of a decoded token, without verifying its signature.
+	unverifiedMessage(signed []byte) ([]byte, bool)
+}
+
+// deriveQueueKey returns a reader producing the key of the given queue, derived from the given master key using HKDF.
+func deriveQueueKey(master []byte, queue int) io.Reader {
+	return hkdf.New(sha256.New, master, nil, []byte(fmt.Sprintf("blitz queue %d", queue)))
+}
+
+// newQueueSigner derives a signer for each of the given number of queues from the signer configured for this Blitz.
+func (blitz *Blitz) newQueueSigner(s signer, queues int) (*queueSigner, error) {
+	qs := &queueSigner{signers: make([]queueKeySigner, queues)}
+	for i := range qs.signers {
+		var err error
+		switch s := s.(type) {
+		case *hmacSigner:
+			key := make([]byte, sha256.Size)
+			if _, err := io.ReadFull(deriveQueueKey(s.key, i), key); err != nil {
+				return nil, err
+			}
+			qs.signers[i], err = newHMACSigner(key, s.tagLength)
+		case *remoteSigner:
+			return nil, errPerQueueRemote
+		case *naclSigner:
+			if len(s.verifyKeys) > 0 {
+				return nil, errPerQueueVerifyKeys
+			}
+			// the first half of the private key is the seed it was generated from
+			qs.signers[i], err = newSigner(deriveQueueKey(s.privKey[:32], i))
+		default:
+			panic("newQueueSigner: unknown signer")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return qs, nil
+}
+
+// Encode implements signer.
+func (qs *queueSigner) Encode(t token) (string, error) {
+	return qs.signers[t.Queue].Encode(t)
+}
+
+// Decode implements signer.
+func (qs *queueSigner) Decode(encoded string) (t token, err error) {
+	// pick the signer of the queue the token claims, so that invalid tokens are only verified once.
+	// the claim can not be trusted yet, but the signature covers it: a token claiming a different queue than it was signed for fails to verify.
+	queue, err := qs.claimedQueue(encoded)
+	if err != nil {
+		return token{}, err
+	}
+
+	t, err = qs.signers[queue].Decode(encoded)
+	if err != nil {
+		return token{}, err
+	}
+	if t.Queue != queue {
+		return token{}, errInvalidSignature
+	}
+	return t, nil
+}
+
+// claimedQueue returns the queue the given token claims to be signed for, without verifying it.
+func (qs *queueSigner) claimedQueue(encoded string) (int, error) {
+	signed, err := decodeSigned(encoded)
+	if err != nil {
+		return 0, err
+	}
+
+	// all signers share the same format
+	message, ok := qs.signers[0].unverifiedMessage(signed)
+	if !ok {
+		return 0, errInvalidFormat
+	}
+
+	var t token
+	if err := t.unmarshal(message); err != nil {
+		return 0, err
+	}
+	if t.Queue < 0 || t.Queue >= len(qs.signers) {
+		return 0, errInvalidSignature
+	}
+	return t.Queue, nil
+}
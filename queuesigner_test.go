@@ -0,0 +1,87 @@
+package blitz
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// countingSigner counts the tokens decoded by the wrapped signer.
+type countingSigner struct {
+	queueKeySigner
+	decoded int
+}
+
+func (s *countingSigner) Decode(encoded string) (token, error) {
+	s.decoded++
+	return s.queueKeySigner.Decode(encoded)
+}
+
+func TestQueueSigner(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"nacl", nil},
+		{"hmac", []Option{WithHMACKey([]byte("0123456789abcdef0123456789abcdef"))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blitz := newTestBlitz(t, append(tt.opts, WithQueues([]uint64{1, 1, 1}), WithPerQueueKeys(true))...)
+			qs := blitz.signer.(*queueSigner)
+
+			counters := make([]*countingSigner, len(qs.signers))
+			for i, s := range qs.signers {
+				counters[i] = &countingSigner{queueKeySigner: s}
+				qs.signers[i] = counters[i]
+			}
+
+			now := time.Now().UTC().Truncate(time.Millisecond)
+			for queue := range qs.signers {
+				encoded, err := qs.Encode(token{From: now, Until: now.Add(time.Second), Queue: queue})
+				if err != nil {
+					t.Fatalf("Encode() error = %v", err)
+				}
+
+				// the token is accepted for its own queue
+				decoded, err := qs.Decode(encoded)
+				if err != nil || decoded.Queue != queue {
+					t.Errorf("Decode() = queue %d, error %v, want queue %d", decoded.Queue, err, queue)
+				}
+
+				// claiming another queue fails to verify, using only the signer of the claimed queue
+				signed, _ := decodeSigned(encoded)
+				message, _ := qs.signers[0].unverifiedMessage(signed)
+				claimed := (queue + 1) % len(qs.signers)
+				message[17] = byte(claimed)
+
+				for _, c := range counters {
+					c.decoded = 0
+				}
+				if _, err := qs.Decode(encodeSigned(signed)); !errors.Is(err, errInvalidSignature) {
+					t.Errorf("Decode() of token claiming queue %d error = %v, want %v", claimed, err, errInvalidSignature)
+				}
+				for i, c := range counters {
+					want := 0
+					if i == claimed {
+						want = 1
+					}
+					if c.decoded != want {
+						t.Errorf("signer of queue %d decoded %d tokens, want %d", i, c.decoded, want)
+					}
+				}
+
+				// claiming a queue that does not exist is rejected without verifying
+				message[17] = byte(len(qs.signers))
+				if _, err := qs.Decode(encodeSigned(signed)); !errors.Is(err, errInvalidSignature) {
+					t.Errorf("Decode() of token claiming missing queue error = %v, want %v", err, errInvalidSignature)
+				}
+				for i, c := range counters {
+					if i != claimed && c.decoded != 0 {
+						t.Errorf("signer of queue %d decoded %d tokens, want 0", i, c.decoded)
+					}
+				}
+			}
+		})
+	}
+}
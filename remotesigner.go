@@ -0,0 +1,63 @@
+package blitz
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Signer signs reservations using a private key held outside of blitz, for example in a KMS or an HSM.
+// Reservations are still verified locally, using the public key.
+//
+// Implementations must be safe for concurrent use.
+type Signer interface {
+	// PublicKey returns the ed25519 public key belonging to the private key used for signing.
+	PublicKey() [32]byte
+
+	// Sign returns the 64-byte ed25519 signature of the given message.
+	// The message is the encoded reservation, and should not be modified.
+	// If signing fails, or ctx is done before it completes, returns an error.
+	Sign(ctx context.Context, message []byte) ([]byte, error)
+}
+
+// DefaultSignTimeout is the maximum time to wait for a [Signer] to sign a reservation.
+const DefaultSignTimeout = time.Second
+
+var (
+	errRemoteWithKeyFile = errors.New("a signer can not be combined with a key file or an hmac key")
+	errPerQueueRemote    = errors.New("per-queue keys can not be combined with a signer")
+	errRemoteSignature   = errors.New("signer returned an invalid signature")
+)
+
+// remoteSigner is a signer that uses a [Signer] to sign tokens, and verifies them locally.
+type remoteSigner struct {
+	*naclSigner // holds the public key, but no private key
+
+	remote  Signer
+	timeout time.Duration // maximum duration to wait for the remote signer
+}
+
+// Encode implements signer.
+func (s *remoteSigner) Encode(t token) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	message := t.marshal()
+	signature, err := s.remote.Sign(ctx, message)
+	if err != nil {
+		return "", fmt.Errorf("signer failed: %w", err)
+	}
+
+	// check the signature, so that no invalid reservations are issued
+	if len(signature) != ed25519.SignatureSize || !ed25519.Verify(s.pubKey[:], message, signature) {
+		return "", errRemoteSignature
+	}
+
+	// a signed nacl message is the signature followed by the message
+	signed := make([]byte, 0, naclSignatureLength)
+	signed = append(signed, signature...)
+	signed = append(signed, message...)
+	return encodeSigned(signed), nil
+}
@@ -2,100 +2,593 @@ package blitz
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
-// reserve reserves a slot in the highest-priority queue with the lowest delay.
+// reserve reserves n slots in the given queue, or a lower one.
 // returns the index used, and the the reservation.
 //
 // if no queue with the given index exists, or all reservations fail, returns nil, -1.
-func (blitz *Blitz) reserve(queue int) (*rate.Reservation, int) {
+func (blitz *Blitz) reserve(queue, n int) (*rate.Reservation, int) {
 	// no such queue exists => bail out
 	if queue < 0 || queue >= len(blitz.limiters) {
 		return nil, -1
 	}
 
-	// make reservations for all the elements
-	reservations := make([]*rate.Reservation, queue+1)
+	switch {
+	case blitz.weighted:
+		return blitz.reserveWeighted(queue, n)
+	case blitz.randomDowngrade:
+		return blitz.reserveRandom(queue, n)
+	default:
+		return blitz.reserveGreedy(queue, n)
+	}
+}
+
+// PeekDelay returns the delay a single request for the given queue would currently receive, and the index of the queue it would be admitted into.
+// It has no side effects: the delay is computed from the tokens currently available, without reserving a slot.
+// If no queue with the given index exists, or no queue could admit the request, returns [rate.InfDuration] and -1.
+//
+// Only the queues are taken into account, not the limits of [WithGlobalRate] or [WithPerClientLimit].
+// PeekDelay is intended for simulators, dashboards and tests.
+// Concurrent requests may receive a different delay.
+// When using [WithRandomDowngrade], it returns the queue with the lowest delay, while requests pick one of the queues randomly.
+func (blitz *Blitz) PeekDelay(queue int) (time.Duration, int) {
+	if queue < 0 || queue >= len(blitz.limiters) {
+		return rate.InfDuration, -1
+	}
+
+	now := blitz.clock.Now()
+	if blitz.weighted {
+		return blitz.peekWeighted(queue, now)
+	}
+
+	// like reserveGreedy, use the highest queue with the lowest delay
+	index, lowest := -1, rate.InfDuration
+	for i := queue; i >= blitz.lowestLender(queue) && lowest > 0; i-- {
+		if delay := blitz.estimateDelay(i, 1, now); delay < lowest {
+			index, lowest = i, delay
+		}
+	}
+	return lowest, index
+}
+
+// peekWeighted is like [Blitz.reserveWeighted], but only computes the delay and queue without reserving a slot.
+func (blitz *Blitz) peekWeighted(queue int, now time.Time) (time.Duration, int) {
+	own := blitz.estimateDelay(queue, 1, now)
+	if own == 0 {
+		return 0, queue
+	}
+
+	// find the lending queue with the lowest ratio
+	chosen, delay := -1, rate.InfDuration
+	var chosenRatio float64
+	for i := queue - 1; i >= blitz.lowestLender(queue); i-- {
+		if blitz.queues[i].Weight == 0 {
+			continue
+		}
+
+		lent := blitz.estimateDelay(i, 1, now)
+		if lent >= own {
+			continue
+		}
+
+		ratio := float64(blitz.borrowed[i].Load()) / float64(blitz.queues[i].Weight)
+		if chosen == -1 || ratio < chosenRatio {
+			chosen, delay, chosenRatio = i, lent, ratio
+		}
+	}
+
+	switch {
+	case chosen != -1:
+		return delay, chosen
+	case own != rate.InfDuration:
+		return own, queue
+	default:
+		return rate.InfDuration, -1
+	}
+}
+
+// isClosedQueue checks if the queue with the given index is closed, that is it has a rate of zero.
+// Closed queues never admit requests, and are skipped without making a reservation.
+func (blitz *Blitz) isClosedQueue(queue int) bool {
+	return blitz.limiters[queue].Burst() == 0
+}
+
+// maxBurst returns the largest burst of the queues a request for the given queue may be admitted into.
+// Requests using up more slots can never be admitted.
+func (blitz *Blitz) maxBurst(queue int) int {
+	burst := 0
+	for i := queue; i >= blitz.lowestLender(queue); i-- {
+		if blitz.mayLend(queue, i) {
+			burst = max(burst, blitz.limiters[i].Burst())
+		}
+	}
+	return burst
+}
 
-	// the index and value of the reservation with the lowest delay
-	lowestDelayIndex := -1
-	lowestDelayValue := rate.InfDuration
+// mayLend checks if the queue with index i may admit requests for the given queue.
+// Closed queues never admit requests, and when weighted, queues with a weight of zero never lend to others.
+func (blitz *Blitz) mayLend(queue, i int) bool {
+	if blitz.isClosedQueue(i) {
+		return false
+	}
+	return i == queue || !blitz.weighted || blitz.queues[i].Weight != 0
+}
 
-	// find the reservation with the lowest (or zero) delay
-	nextInit := queue
-	for nextInit >= 0 && lowestDelayValue > 0 {
-		reservations[nextInit] = blitz.limiters[nextInit].Reserve()
+// lowestLender returns the index of the lowest queue requests for the given queue may borrow slots from.
+// It is queue itself minus the borrow depth, or 0 if the depth is unlimited.
+func (blitz *Blitz) lowestLender(queue int) int {
+	if blitz.borrowDepth <= 0 {
+		return 0
+	}
+	return max(queue-blitz.borrowDepth, 0)
+}
 
-		// if the delay is lower
-		delay := reservations[nextInit].Delay()
-		if delay < lowestDelayValue {
-			lowestDelayIndex = nextInit
-			lowestDelayValue = delay
+// reserveGreedy reserves n slots in the highest-priority queue with the lowest delay.
+//
+// To not allocate a reservation for every queue, the queue is picked using the slots currently available, and only it is reserved on.
+// If a concurrent request took the slots in the meantime, the delay is higher than estimated,
+// and the other queues are reserved on as well to find the lowest delay, see [Blitz.reserveLowest].
+func (blitz *Blitz) reserveGreedy(queue, n int) (*rate.Reservation, int) {
+	now := blitz.clock.Now()
+
+	// estimate the delay of each queue, stopping at the first without a delay
+	index, estimate := -1, rate.InfDuration
+	for i := queue; i >= blitz.lowestLender(queue) && estimate > 0; i-- {
+		if delay := blitz.estimateDelay(i, n, now); delay < estimate {
+			index, estimate = i, delay
 		}
+	}
+	if index == -1 {
+		return nil, -1
+	}
 
-		// decrease the index
-		nextInit--
+	reservation := blitz.limiters[index].ReserveN(now, n)
+	if delay := reservation.DelayFrom(now); delay <= estimate {
+		return reservation, index
+	}
+	return blitz.reserveLowest(queue, n, now, reservation, index)
+}
+
+// reserveLowest reserves n slots in each queue from the given one down to the lowest lender, and keeps the one with the lowest delay.
+// It starts with the given reservation on the queue with index skip, which is not reserved on again.
+func (blitz *Blitz) reserveLowest(queue, n int, now time.Time, lowest *rate.Reservation, skip int) (*rate.Reservation, int) {
+	lowestIndex, lowestDelay := skip, lowest.DelayFrom(now)
+	if !lowest.OK() {
+		lowest, lowestIndex = nil, -1
+	}
+
+	// find the reservation with the lowest (or zero) delay.
+	// each reservation is made on a different limiter, so cancelling a replaced one restores its slots.
+	for i := queue; i >= blitz.lowestLender(queue) && lowestDelay > 0; i-- {
+		// closed queues never admit anything
+		if i == skip || blitz.isClosedQueue(i) {
+			continue
+		}
+
+		reservation := blitz.limiters[i].ReserveN(now, n)
+		delay := reservation.DelayFrom(now)
+		if delay >= lowestDelay {
+			reservation.CancelAt(now)
+			continue
+		}
+
+		if lowest != nil {
+			lowest.CancelAt(now)
+		}
+		lowest, lowestIndex, lowestDelay = reservation, i, delay
+	}
+
+	if lowestIndex == -1 {
+		return nil, -1
+	}
+	return lowest, lowestIndex
+}
+
+// reserveWeighted reserves a slot in the given queue, borrowing from lower queues proportionally to their weights.
+//
+// If the given queue can admit a request immediately, it is used.
+// Otherwise, a slot is borrowed from a lower queue with non-zero weight whose delay is lower than the one of the given queue.
+// Among these, the queue i with the lowest ratio borrowed[i] / weight[i] is used, where borrowed[i] counts the slots lent by queue i so far.
+// Over time, this makes each lending queue lend a share of slots proportional to its weight.
+//
+// If no lower queue has a lower delay, the given queue is used.
+func (blitz *Blitz) reserveWeighted(queue, n int) (*rate.Reservation, int) {
+	// reservations made, indexed relative to the lowest queue that may lend
+	lowest := blitz.lowestLender(queue)
+	reservations := make([]*rate.Reservation, queue+1-lowest)
+	now := blitz.clock.Now()
+
+	// the requested queue can admit immediately => use it
+	ownDelay := rate.InfDuration
+	if !blitz.isClosedQueue(queue) {
+		reservations[queue-lowest] = blitz.limiters[queue].ReserveN(now, n)
+		ownDelay = reservations[queue-lowest].DelayFrom(now)
+		if ownDelay == 0 {
+			return reservations[queue-lowest], queue
+		}
+	}
+
+	// find the lending queue with the lowest ratio
+	chosen := -1
+	var chosenRatio float64
+	for i := queue - 1; i >= lowest; i-- {
+		if blitz.queues[i].Weight == 0 || blitz.isClosedQueue(i) {
+			continue
+		}
+
+		reservations[i-lowest] = blitz.limiters[i].ReserveN(now, n)
+		if reservations[i-lowest].DelayFrom(now) >= ownDelay {
+			continue
+		}
+
+		ratio := float64(blitz.borrowed[i].Load()) / float64(blitz.queues[i].Weight)
+		if chosen == -1 || ratio < chosenRatio {
+			chosen, chosenRatio = i, ratio
+		}
+	}
+
+	// nothing to borrow from => use the requested queue
+	if chosen == -1 && reservations[queue-lowest] != nil && reservations[queue-lowest].OK() {
+		chosen = queue
 	}
 
 	// cancel all the non-picked reservations
-	nextInit++
-	for nextInit < len(reservations) {
-		if nextInit != lowestDelayIndex {
-			reservations[nextInit].Cancel()
+	for i, r := range reservations {
+		if r != nil && i+lowest != chosen {
+			r.CancelAt(now)
 		}
-		nextInit++
 	}
 
-	// use the lowest delay
-	if lowestDelayIndex >= 0 {
-		return reservations[lowestDelayIndex], lowestDelayIndex
-	} else {
+	switch chosen {
+	case -1:
 		return nil, -1
+	case queue:
+		return reservations[chosen-lowest], chosen
+	default:
+		blitz.borrowed[chosen].Add(uint64(n))
+		return reservations[chosen-lowest], chosen
 	}
 }
 
-type reservation struct {
+// reserveRandom reserves n slots in the given queue, or randomly picks a lower queue if the given one can not admit immediately.
+//
+// Each queue that can admit the request is picked with a probability inversely proportional to its delay plus the time it takes one of its slots to refill.
+// Unlike [Blitz.reserveGreedy], this does not always pick the lower queue with the lowest delay, which would drain it completely.
+func (blitz *Blitz) reserveRandom(queue, n int) (*rate.Reservation, int) {
+	// reservations made and their weights, indexed relative to the lowest queue that may lend
+	lowest := blitz.lowestLender(queue)
+	reservations := make([]*rate.Reservation, queue+1-lowest)
+	weights := make([]float64, queue+1-lowest)
+	now := blitz.clock.Now()
+
+	var total float64
+	for i := queue; i >= lowest; i-- {
+		if blitz.isClosedQueue(i) {
+			continue
+		}
+
+		reservations[i-lowest] = blitz.limiters[i].ReserveN(now, n)
+		delay := reservations[i-lowest].DelayFrom(now)
+
+		// the requested queue can admit immediately => use it
+		if i == queue && delay == 0 {
+			return reservations[i-lowest], i
+		}
+		if delay == rate.InfDuration {
+			continue
+		}
+
+		slot := 1 / float64(blitz.limiters[i].Limit())
+		weights[i-lowest] = 1 / (delay.Seconds() + slot)
+		total += weights[i-lowest]
+	}
+
+	// pick a queue with probability proportional to its weight
+	chosen := -1
+	if total > 0 {
+		target := rand.Float64() * total
+		for i := queue; i >= lowest; i-- {
+			weight := weights[i-lowest]
+			if weight == 0 {
+				continue
+			}
+			chosen = i
+			if target < weight {
+				break
+			}
+			target -= weight
+		}
+	}
+
+	// cancel all the non-picked reservations
+	for i, r := range reservations {
+		if r != nil && i+lowest != chosen {
+			r.CancelAt(now)
+		}
+	}
+
+	if chosen == -1 {
+		return nil, -1
+	}
+	return reservations[chosen-lowest], chosen
+}
+
+// admission holds the reservations needed to admit a single request.
+type admission struct {
+	Queue int // index of the queue used
+
+	reservations []*rate.Reservation // reservations made, the first one being for the queue, followed by the global one if enabled
+	clock        Clock               // clock the reservations were made with
+}
+
+// DelayFrom returns the delay from now until all reservations allow the request to proceed.
+// If any of them never does, returns [rate.InfDuration].
+func (a admission) DelayFrom(now time.Time) time.Duration {
+	var delay time.Duration
+	for _, r := range a.reservations {
+		delay = max(delay, r.DelayFrom(now))
+	}
+	return delay
+}
+
+// Delay is like DelayFrom, but uses the current time.
+func (a admission) Delay() time.Duration {
+	return a.DelayFrom(a.clock.Now())
+}
+
+// Cancel cancels all reservations.
+func (a admission) Cancel() {
+	now := a.clock.Now()
+	for _, r := range a.reservations {
+		r.CancelAt(now)
+	}
+}
+
+// returnSlots returns the cost slots used up by the given admission to its queue and the global limiter.
+// Unlike [admission.Cancel], it also returns slots once the time of the admission has passed.
+//
+// A cancelled reservation does not restore anything once its time has passed, such as reservations without a delay,
+// and does not restore the slots used up by reservations made after it.
+// So instead the slots are returned by reserving a negative number of them, which adds them to the limiter, up to its burst.
+func (blitz *Blitz) returnSlots(a admission, cost int) {
+	now := blitz.clock.Now()
+	reservations := a.reservations
+	if limiter := blitz.limiters[a.Queue]; limiter.Limit() > 0 {
+		limiter.ReserveN(now, -cost)
+	}
+	reservations = reservations[1:]
+	if blitz.global != nil {
+		blitz.global.ReserveN(now, -cost)
+		reservations = reservations[1:]
+	}
+	for _, r := range reservations {
+		r.CancelAt(now)
+	}
+}
+
+// jitterDelay returns a random duration to add to a non-zero delay of a request admitted into the given queue.
+// It is uniformly distributed between zero and the configured fraction of the refill duration of the queue.
+func (blitz *Blitz) jitterDelay(queue int) time.Duration {
+	limit := time.Duration(blitz.jitter * float64(blitz.queueEvery(queue)))
+	if limit <= 0 {
+		return 0
+	}
+
+	var buf [8]byte
+	if _, err := io.ReadFull(blitz.rand, buf[:]); err != nil {
+		return 0
+	}
+	return time.Duration(binary.LittleEndian.Uint64(buf[:]) % uint64(limit))
+}
+
+// admit reserves everything needed to admit a request from the given client into the given queue, or a lower one.
+// The request uses up cost slots of the queue.
+// If no queue can admit the request, returns the code of the reason why, see [Blitz.rejectCode].
+// Otherwise, the code is empty.
+func (blitz *Blitz) admit(queue int, client string, cost int) (admission, string) {
+	reservation, index := blitz.reserve(queue, cost)
+	if index == -1 {
+		return admission{}, blitz.rejectCode(queue, cost)
+	}
+
+	a := admission{Queue: index, reservations: []*rate.Reservation{reservation}, clock: blitz.clock}
+	if blitz.global != nil {
+		// the global limiter can never admit the request => reject it, even if the queue could
+		global := blitz.global.ReserveN(a.clock.Now(), cost)
+		if !global.OK() {
+			a.Cancel()
+			return admission{}, CodeInvalidCount
+		}
+		a.reservations = append(a.reservations, global)
+	}
+	if blitz.clients != nil {
+		a.reservations = append(a.reservations, blitz.clients.reserve(client, a.clock.Now()))
+	}
+	return a, ""
+}
+
+// Reservation is the response to a request for a reservation, encoded as json.
+// It is also sent when a reservation can not be used because it has expired.
+type Reservation struct {
 	Success             bool
+	Code                string `json:",omitempty"` // code of the reason the reservation was not successful, one of the Code constants, or CodeUnsigned
+	Message             string `json:",omitempty"` // human-readable reason the reservation was not successful
 	Queue               int
+	Count               int // number of requests the reservation was granted for
 	DelayInMilliseconds int64
 
 	XBlitzReservation string `json:"X-Blitz-Reservation"`
 
 	TokenValidFromUnixMilliseconds  int64
 	TokenValidUntilUnixMilliseconds int64
+
+	SendAtUnixMilliseconds int64 // recommended time to use the reservation at
+	WindowInMilliseconds   int64 // duration of the window the reservation can be used in
+
+	RetryAfterMs int64 // when not successful, the time to wait before reserving again
 }
 
-// signReservation creates and signs a reservation object for the given queue.
-func (wrap *Blitz) signReservation(queue int) (rs reservation) {
-	reserve, index := wrap.reserve(queue)
-	if index == -1 {
-		rs.Success = false
+// Codes of reasons for a reservation not to be successful.
+// They are sent to clients in the Code field of the reservation.
+const (
+	CodeQueueFull    = "queue_full"     // the queue can not admit the request
+	CodeInvalidQueue = "invalid_queue"  // the requested queue does not exist
+	CodeDelayTooLong = "delay_too_long" // the delay exceeds the maximum reservation delay
+	CodeInvalidCount = "invalid_count"  // the requested number of requests is invalid, or exceeds the burst of the queue
+	CodeExpired      = "expired"        // the reservation used has expired
+	CodeRateLimited  = "rate_limited"   // too many reservations are being requested or pending, see [WithReservationRate] and [WithMaxPendingConfirmations]
+
+	// CodeUnsigned marks a successful reservation without a token, as it could not be signed, see [FailOpen].
+	// The client should send its request right away without a reservation, where it is admitted as usual.
+	CodeUnsigned = "unsigned"
+)
+
+// codeMessages holds a human-readable message for each code
+var codeMessages = map[string]string{
+	CodeQueueFull:    "queue can not admit requests",
+	CodeInvalidQueue: "queue does not exist",
+	CodeDelayTooLong: "delay exceeds the maximum reservation delay",
+	CodeInvalidCount: "count must be a positive integer within the burst of the queue, and 1 for single-use reservations",
+	CodeExpired:      "reservation expired",
+	CodeRateLimited:  "too many reservation requests",
+	CodeUnsigned:     "reservation could not be signed, send the request without one",
+}
+
+// fail marks the reservation as not successful with the given code.
+func (rs *Reservation) fail(code string) {
+	rs.Success = false
+	rs.Code = code
+	rs.Message = codeMessages[code]
+}
+
+// reservationCount returns the number of requests a reservation is requested for, using the [HeaderCount] header.
+// Single-use reservations can only be used for a single request.
+// If the header is invalid, returns false.
+func (blitz *Blitz) reservationCount(r *http.Request) (int, bool) {
+	value := r.Header.Get(HeaderCount)
+	if value == "" {
+		return 1, true
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 || (count > 1 && blitz.nonces != nil) {
+		return 0, false
+	}
+	return count, true
+}
+
+// validity returns the duration reservations for the given queue are valid for.
+func (wrap *Blitz) validity(queue int) time.Duration {
+	if wrap.reservationTTL > 0 {
+		return wrap.reservationTTL
+	}
+	return wrap.queueEvery(queue)
+}
+
+// signReservation creates and signs a reservation object for the given client and queue, using up cost slots.
+// The reservation is bound to the given request, if any.
+func (wrap *Blitz) signReservation(queue int, client string, cost int, bind binding) (rs Reservation, err error) {
+	t := token{Binding: bind}
+	if _, err := io.ReadFull(wrap.rand, t.Nonce[:]); err != nil {
+		return rs, err
+	}
+
+	admission, code := wrap.admit(queue, client, cost)
+	if code != "" {
+		rs.fail(code)
+		return
+	}
+
+	now := wrap.clock.Now().UTC()
+
+	delay := admission.DelayFrom(now)
+	if delay == rate.InfDuration {
+		admission.Cancel()
+		rs.fail(CodeQueueFull)
 		return
 	}
+	if delay > 0 {
+		delay += wrap.jitterDelay(admission.Queue)
+	}
+
+	// don't tell clients to wait for too long
+	if wrap.maxReservationDelay > 0 && delay > wrap.maxReservationDelay {
+		admission.Cancel()
+		rs.fail(CodeDelayTooLong)
+		rs.DelayInMilliseconds = delay.Milliseconds()
+		rs.RetryAfterMs = (delay - wrap.maxReservationDelay).Milliseconds()
+		return
+	}
+
+	index := admission.Queue
 	rs.Queue = index
 	rs.Success = true
+	t.Queue = index
 
-	now := time.Now().UTC()
+	sendAt := now.Add(delay)
+	t.From = sendAt
+	t.Until = sendAt.Add(wrap.validity(index))
 
-	delay := reserve.DelayFrom(now)
-	from := now.Add(delay)
-	to := from.Add(wrap.every)
+	// no delay => make the token valid slightly in the past, so that it is usable immediately
+	if delay == 0 {
+		t.From = t.From.Add(-wrap.validFromSlack)
+	}
 
 	rs.DelayInMilliseconds = delay.Milliseconds()
-	rs.TokenValidFromUnixMilliseconds = from.UnixMilli()
-	rs.TokenValidUntilUnixMilliseconds = to.UnixMilli()
+	rs.TokenValidFromUnixMilliseconds = t.From.UnixMilli()
+	rs.TokenValidUntilUnixMilliseconds = t.Until.UnixMilli()
+
+	// requests sent early are held until the reservation is valid, but requests sent late are rejected.
+	// so recommend to send at the start of the window, leaving all of it to absorb latency.
+	rs.SendAtUnixMilliseconds = sendAt.UnixMilli()
+	rs.WindowInMilliseconds = t.Until.Sub(sendAt).Milliseconds()
 
 	// encode the reservation token
-	rs.XBlitzReservation = wrap.signer.Encode(from, to)
+	rs.XBlitzReservation, err = wrap.signer.Encode(t)
+	if err != nil {
+		wrap.returnSlots(admission, cost)
+		return Reservation{}, err
+	}
+
+	// cancel the reservation unless confirmed
+	if wrap.confirms != nil && !wrap.provision(t, admission, cost) {
+		wrap.returnSlots(admission, cost)
+		rs = Reservation{}
+		rs.fail(CodeRateLimited)
+		rs.RetryAfterMs = wrap.confirmGrace.Milliseconds()
+		return rs, nil
+	}
 
 	return
 }
 
+var errReservationReplayed = errors.New("reservation already used")
+
+type errReservationQueue struct {
+	Queue, Claimed int
+}
+
+func (err errReservationQueue) Error() string {
+	return fmt.Sprintf("reservation for queue %d can not be used for queue %d", err.Queue, err.Claimed)
+}
+
 type errReservationExpired struct {
+	Queue                   int
 	ValidUntil, CurrentTime time.Time
 }
 
@@ -103,36 +596,173 @@ func (err errReservationExpired) Error() string {
 	return fmt.Sprintf("reservation expired: valid through %d, but it is now %d", err.ValidUntil.UnixMilli(), err.CurrentTime.UnixMilli())
 }
 
-// useReservation uses the given reservation.
+// earlyWait returns how long to hold a request using the given reservation, which is valid from d in the future.
 //
-// If a reservation is invalid, returns false.
-// If a request is not yet valid, waits until it is, and then returns true.
-func (wrap *Blitz) useReservation(ctx context.Context, token string) error {
+// Clients send their requests around the time their reservation is valid from, so they are held for at most the clock skew and the refill duration of the queue.
+// A longer wait means the clock stepped backward since the reservation was issued, or the one of the server that issued it is ahead.
+// As the times of reservations are wall-clock times, this can not be told apart any other way.
+// So rather than holding the request for the size of the step, the wait is clamped and a warning is logged.
+func (wrap *Blitz) earlyWait(t token, d time.Duration, client string) time.Duration {
+	limit := wrap.skew + wrap.queueEvery(t.Queue)
+	if d <= limit {
+		return d
+	}
+
+	wrap.logEvent(event{Name: eventClockStep, Client: client, Queue: t.Queue, Delay: d - limit, Err: errReservationEarly})
+	return limit
+}
+
+// estimateDelay estimates the delay n new requests on the given queue would receive at the given time, without reserving slots.
+// If the queue can never admit them, returns [rate.InfDuration].
+func (wrap *Blitz) estimateDelay(queue, n int, now time.Time) time.Duration {
+	limiter := wrap.limiters[queue]
+	if n > limiter.Burst() || limiter.Limit() <= 0 {
+		return rate.InfDuration
+	}
+
+	missing := float64(n) - limiter.TokensAt(now)
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / float64(limiter.Limit()) * float64(time.Second))
+}
+
+// serveTooManyReservations rejects a reservation request exceeding the rate set by [WithReservationRate].
+// It tells the client when the next request would be allowed.
+func (blitz *Blitz) serveTooManyReservations(w http.ResponseWriter) {
+	var rs Reservation
+	rs.fail(CodeRateLimited)
+
+	limiter := blitz.reserveLimiter
+	retry := time.Duration((1 - limiter.TokensAt(blitz.clock.Now())) / float64(limiter.Limit()) * float64(time.Second))
+	rs.RetryAfterMs = retry.Milliseconds()
+
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retry.Seconds())), 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(rs)
+}
+
+// findReservation returns the reservation passed with the given request, or the empty string if there is none.
+// It is taken from the [HeaderReservation] header, or else the query parameter or cookie configured.
+//
+// If a reservation is found in a query parameter or a cookie, it is removed from the request.
+func (wrap *Blitz) findReservation(r *http.Request) string {
+	if reservation := r.Header.Get(HeaderReservation); reservation != "" {
+		return reservation
+	}
+
+	if wrap.reservationQuery != "" {
+		query := r.URL.Query()
+		if reservation := query.Get(wrap.reservationQuery); reservation != "" {
+			r.URL.RawQuery = removeQueryParam(r.URL.RawQuery, wrap.reservationQuery)
+			return reservation
+		}
+	}
+
+	if wrap.reservationCookie != "" {
+		if cookie, err := r.Cookie(wrap.reservationCookie); err == nil && cookie.Value != "" {
+			removeCookie(r, wrap.reservationCookie)
+			return cookie.Value
+		}
+	}
+
+	return ""
+}
+
+// removeQueryParam removes all values of the parameter with the given name from the raw query.
+// The remaining parameters are kept byte for byte, in their original order and escaping.
+func removeQueryParam(rawQuery, name string) string {
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
+
+// removeCookie removes all cookies with the given name from the request.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// useReservation uses the given reservation for a request claiming the given queue, or -1 if it claims none.
+// A reservation can only be used for the queue it was issued for, or a higher one, see [HeaderQueue].
+// A request that claims no queue accepts a reservation for any queue.
+// When reservations are bound to requests, it can only be used for a request with the given binding.
+//
+// If a reservation is invalid, expired or has already been used in single-use mode, returns an error.
+// If a request is not yet valid, waits until it is, and then returns the decoded reservation.
+// In single-use mode, the reservation is only marked as used once the wait is over.
+func (wrap *Blitz) useReservation(ctx context.Context, encoded string, claimed int, bind binding, client string) (token, error) {
 
 	// decode the message
-	validFrom, validUntil, err := wrap.signer.Decode(token)
+	t, err := wrap.signer.Decode(encoded)
 	if err != nil {
-		return err
+		return token{}, err
 	}
 
-	// check validity
-	now := time.Now().UTC()
-	switch {
-	// valid now!
-	case now.After(validFrom) && now.Before(validUntil):
-		return nil
+	// check that the queue matches
+	if t.Queue < 0 || t.Queue >= len(wrap.limiters) || (claimed != -1 && t.Queue > claimed) {
+		return token{}, errReservationQueue{Queue: t.Queue, Claimed: claimed}
+	}
 
-		// not yet valid => wait until it is
-	case now.Before(validFrom):
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(time.Until(validFrom)):
-			return nil
+	// check that the request matches
+	if wrap.bindRequest && t.Binding != bind {
+		return token{}, errReservationBinding
+	}
+
+	// widen the window to tolerate clock skew
+	from := t.From.Add(-wrap.skew)
+	until := t.Until.Add(wrap.skew)
+
+	// check that the signature has not expired
+	now := wrap.clock.Now().UTC()
+	if !now.Before(until) {
+		return token{}, errReservationExpired{Queue: t.Queue, ValidUntil: t.Until, CurrentTime: now}
+	}
+
+	// using a reservation confirms it
+	if wrap.confirms != nil {
+		if err := wrap.confirm(t.Nonce); err != nil {
+			return token{}, err
 		}
+	}
 
-	// signature expired
-	default:
-		return errReservationExpired{ValidUntil: validUntil, CurrentTime: now}
+	// not yet valid => wait until it is
+	// the nonce is only used afterwards, so a request giving up while waiting does not use up the reservation
+	if now.Before(from) {
+		if err := wrap.wait(ctx, wrap.earlyWait(t, from.Sub(now), client)); err != nil {
+			return token{}, err
+		}
+	}
+
+	// in single-use mode, mark the token as used
+	if wrap.nonces != nil {
+		fresh, err := wrap.nonces.Use(ctx, t.Nonce[:], until)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return token{}, ctx.Err()
+		case err != nil && !wrap.failOpen(eventStoreFailed, client, t.Queue, err):
+			return token{}, fmt.Errorf("%w: %w", errNonceStore, err)
+		case err != nil:
+			// failing open => the signature is valid, so treat it as unused
+			fresh = true
+		}
+		if !fresh {
+			return token{}, errReservationReplayed
+		}
 	}
+
+	return t, nil
 }
@@ -0,0 +1,727 @@
+package blitz
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// requestReservation requests a reservation from blitz, passing the given headers.
+func requestReservation(t testing.TB, blitz *Blitz, headers map[string]string) (int, Reservation) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, DefaultControlPath, nil)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	blitz.ServeHTTP(w, r)
+
+	var reservation Reservation
+	if err := json.NewDecoder(w.Body).Decode(&reservation); err != nil {
+		t.Fatalf("decoding reservation: %v", err)
+	}
+	return w.Code, reservation
+}
+
+func TestServeReservationCount(t *testing.T) {
+	cost3 := WithCostFunc(func(r *http.Request) int { return 3 })
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		headers map[string]string
+
+		wantStatus int
+		wantCode   string
+		wantQueue  int
+	}{
+		{
+			name:       "within burst",
+			opts:       []Option{WithQueues([]uint64{9}), cost3},
+			headers:    map[string]string{HeaderCount: "3"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "exceeds burst",
+			opts:       []Option{WithQueues([]uint64{9}), cost3},
+			headers:    map[string]string{HeaderCount: "4"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CodeInvalidCount,
+		},
+		{
+			name:       "overflows to zero",
+			opts:       []Option{WithQueues([]uint64{9}), WithCostFunc(func(r *http.Request) int { return 1 << 32 })},
+			headers:    map[string]string{HeaderCount: strconv.Itoa(1 << 32)},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CodeInvalidCount,
+		},
+		{
+			name:       "overflows to negative",
+			opts:       []Option{WithQueues([]uint64{9}), cost3},
+			headers:    map[string]string{HeaderCount: strconv.Itoa(math.MaxInt/3 + 1)},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CodeInvalidCount,
+		},
+		{
+			name:       "closed queue borrows",
+			opts:       []Option{WithQueues([]uint64{9, 0})},
+			headers:    map[string]string{HeaderQueue: "1", HeaderCount: "5"},
+			wantStatus: http.StatusOK,
+			wantQueue:  0,
+		},
+		{
+			name:       "exceeds burst of lenders",
+			opts:       []Option{WithQueues([]uint64{9, 0})},
+			headers:    map[string]string{HeaderQueue: "1", HeaderCount: "10"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   CodeInvalidCount,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blitz := newTestBlitz(t, tt.opts...)
+
+			status, reservation := requestReservation(t, blitz, tt.headers)
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if reservation.Code != tt.wantCode {
+				t.Errorf("Code = %q, want %q", reservation.Code, tt.wantCode)
+			}
+			if reservation.Success && reservation.Queue != tt.wantQueue {
+				t.Errorf("Queue = %d, want %d", reservation.Queue, tt.wantQueue)
+			}
+
+			// rejected requests must not change the tokens of any queue
+			if reservation.Success {
+				return
+			}
+			now := blitz.clock.Now()
+			for i, l := range blitz.limiters {
+				if tokens, burst := l.TokensAt(now), float64(l.Burst()); tokens != burst {
+					t.Errorf("queue %d has %g tokens, want %g", i, tokens, burst)
+				}
+			}
+		})
+	}
+}
+
+func TestPeekDelay(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"greedy", []Option{WithQueues([]uint64{2, 3})}},
+		{"weighted", []Option{WithQueueConfigs([]QueueConfig{{Rate: 2, Weight: 1}, {Rate: 1, Weight: 2}, {Rate: 3}})}},
+		{"borrow depth", []Option{WithQueues([]uint64{5, 1, 1}), WithBorrowDepth(1)}},
+		{"closed", []Option{WithQueues([]uint64{0, 0, 0})}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			blitz := newTestBlitz(t, append(tt.opts, WithClock(clock))...)
+			queue := len(blitz.limiters) - 1
+
+			// peek, then make the reservation peeked at, until the queues are exhausted
+			for i := 0; i < 10; i++ {
+				now := clock.Now()
+				before := make([]float64, len(blitz.limiters))
+				for j, l := range blitz.limiters {
+					before[j] = l.TokensAt(now)
+				}
+
+				delay, index := blitz.PeekDelay(queue)
+
+				for j, l := range blitz.limiters {
+					if tokens := l.TokensAt(now); tokens != before[j] {
+						t.Fatalf("PeekDelay() changed tokens of queue %d from %g to %g", j, before[j], tokens)
+					}
+				}
+
+				reservation, got := blitz.reserve(queue, 1)
+				if got != index {
+					t.Fatalf("step %d: PeekDelay() index = %d, but reserve() used %d", i, index, got)
+				}
+				if got == -1 {
+					return
+				}
+				if want := reservation.DelayFrom(now); delay != want {
+					t.Fatalf("step %d: PeekDelay() delay = %v, but reserve() delay = %v", i, delay, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPeekDelayInvalidQueue(t *testing.T) {
+	blitz := newTestBlitz(t)
+	for _, queue := range []int{-1, 1} {
+		if delay, index := blitz.PeekDelay(queue); delay != rate.InfDuration || index != -1 {
+			t.Errorf("PeekDelay(%d) = %v, %d, want %v, -1", queue, delay, index, rate.InfDuration)
+		}
+	}
+}
+
+func TestUseReservationClockStep(t *testing.T) {
+	clock := newFakeClock()
+	var logs bytes.Buffer
+	blitz := newTestBlitz(t, WithClock(clock), WithRefill(time.Second), WithLogger(log.New(&logs, "", 0)))
+
+	// a reservation issued before the clock stepped back by an hour
+	now := clock.Now()
+	encoded, err := blitz.signer.Encode(token{From: now.Add(time.Hour), Until: now.Add(time.Hour + time.Second)})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(HeaderReservation, encoded)
+		w := httptest.NewRecorder()
+		blitz.ServeHTTP(w, r)
+		done <- w
+	}()
+
+	// the request is held for the skew and refill duration only, rather than the hour
+	for clock.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(DefaultClockSkew + time.Second)
+
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request still held after the clamped wait")
+	}
+
+	if !strings.Contains(logs.String(), errReservationEarly.Error()) {
+		t.Errorf("logs = %q, want a warning about the clock step", logs.String())
+	}
+}
+
+// countingReader counts the bytes read from the wrapped reader.
+type countingReader struct {
+	io.Reader
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func TestReserveRandomDistribution(t *testing.T) {
+	// lower queues are large enough to never run out, so they keep a delay of zero.
+	// each is then picked with a probability proportional to its rate, the requested queue is drained and almost never picked.
+	random := &countingReader{Reader: crand.Reader}
+	blitz := newTestBlitz(t,
+		WithClock(newFakeClock()),
+		WithRand(random),
+		WithRandomDowngrade(true),
+		WithQueues([]uint64{3_000_000, 1_000_000, 1}),
+	)
+	if _, index := blitz.reserve(2, 1); index != 2 {
+		t.Fatalf("first reservation used queue %d, want 2", index)
+	}
+
+	const n = 20_000
+	read := random.n.Load()
+	picked := make([]int, 3)
+	for i := 0; i < n; i++ {
+		_, index := blitz.reserve(2, 1)
+		picked[index]++
+	}
+
+	want := []float64{0.75, 0.25, 0}
+	for i, count := range picked {
+		if share := float64(count) / n; math.Abs(share-want[i]) > 0.02 {
+			t.Errorf("queue %d picked %d of %d times (%.3f), want %.3f", i, count, n, share, want[i])
+		}
+	}
+
+	// picking must not read the source of randomness of the server, which may not be safe for concurrent use
+	if read != random.n.Load() {
+		t.Errorf("picking queues read %d bytes from the server randomness", random.n.Load()-read)
+	}
+}
+
+func TestJitterDelayDistribution(t *testing.T) {
+	// a seeded math/rand.Rand is not safe for concurrent use, so this also checks that reads are serialized
+	blitz := newTestBlitz(t, WithRand(rand.New(rand.NewSource(1))), WithRefill(time.Second), WithJitter(0.5))
+	const limit = 500 * time.Millisecond
+
+	const workers, n = 4, 5_000
+	buckets := make([]atomic.Int64, 10)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				jitter := blitz.jitterDelay(0)
+				if jitter < 0 || jitter >= limit {
+					t.Errorf("jitterDelay() = %v, want within [0, %v)", jitter, limit)
+					return
+				}
+				buckets[jitter*time.Duration(len(buckets))/limit].Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// each tenth of the range receives a tenth of the jitter
+	for i := range buckets {
+		if share := float64(buckets[i].Load()) / (workers * n); math.Abs(share-0.1) > 0.015 {
+			t.Errorf("bucket %d received %.3f of the jitter, want 0.1", i, share)
+		}
+	}
+}
+
+func TestFindReservationQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawQuery string
+
+		wantReservation string
+		wantRawQuery    string
+	}{
+		{"only", "r=abc", "abc", ""},
+		{"first", "r=abc&b=2&a=1", "abc", "b=2&a=1"},
+		{"middle", "b=2&r=abc&a=1", "abc", "b=2&a=1"},
+		{"last", "b=2&a=1&r=abc", "abc", "b=2&a=1"},
+		{"repeated", "r=abc&x=1&r=def", "abc", "x=1"},
+		{"escaped name", "%72=abc&x=1", "abc", "x=1"},
+		{"keeps escaping", "q=a%20b+c&r=abc&path=%2F%2f&flag", "abc", "q=a%20b+c&path=%2F%2f&flag"},
+		{"keeps similar names", "rr=1&r=abc&r2=2", "abc", "rr=1&r2=2"},
+		{"absent", "b=2&a=1", "", "b=2&a=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blitz := newTestBlitz(t, WithReservationQuery("r"))
+
+			r := httptest.NewRequest(http.MethodGet, "/path?"+tt.rawQuery, nil)
+			if got := blitz.findReservation(r); got != tt.wantReservation {
+				t.Errorf("findReservation() = %q, want %q", got, tt.wantReservation)
+			}
+			if r.URL.RawQuery != tt.wantRawQuery {
+				t.Errorf("RawQuery = %q, want %q", r.URL.RawQuery, tt.wantRawQuery)
+			}
+		})
+	}
+}
+
+func TestReadmeReservation(t *testing.T) {
+	readme, err := os.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	field := func(name string) string {
+		match := regexp.MustCompile(`"` + name + `":\s*"?([^",]*)"?,`).FindSubmatch(readme)
+		if match == nil {
+			t.Fatalf("README.md has no %q field", name)
+		}
+		return string(match[1])
+	}
+	millis := func(name string) time.Time {
+		ms, err := strconv.ParseInt(field(name), 10, 64)
+		if err != nil {
+			t.Fatalf("README.md field %q: %v", name, err)
+		}
+		return time.UnixMilli(ms)
+	}
+
+	signed, err := decodeSigned(field(HeaderReservation))
+	if err != nil {
+		t.Fatalf("decoding the reservation of README.md: %v", err)
+	}
+	message, ok := (&naclSigner{}).unverifiedMessage(signed)
+	if !ok {
+		t.Fatal("the reservation of README.md is too short")
+	}
+	var tok token
+	if err := tok.unmarshal(message); err != nil {
+		t.Fatalf("decoding the reservation of README.md: %v", err)
+	}
+
+	if from := millis("TokenValidFromUnixMilliseconds"); !tok.From.Equal(from) {
+		t.Errorf("token valid from %s, README.md says %s", tok.From, from)
+	}
+	if until := millis("TokenValidUntilUnixMilliseconds"); !tok.Until.Equal(until) {
+		t.Errorf("token valid until %s, README.md says %s", tok.Until, until)
+	}
+}
+
+func TestWeightedProportions(t *testing.T) {
+	const borrows = 2400
+
+	tests := []struct {
+		name    string
+		weights []uint64 // weights of the lenders, from the lowest queue up
+
+		want []int // slots lent by each lender
+	}{
+		{"equal", []uint64{1, 1}, []int{1200, 1200}},
+		{"one to three", []uint64{1, 3}, []int{600, 1800}},
+		{"three lenders", []uint64{1, 2, 5}, []int{300, 600, 1500}},
+		{"zero weight never lends", []uint64{0, 1, 2}, []int{0, 800, 1600}},
+	}
+	for _, tt := range tests {
+		for _, mode := range []string{"reserve", "allow"} {
+			t.Run(tt.name+"/"+mode, func(t *testing.T) {
+				// the highest queue is closed, so it is saturated and borrows every slot
+				// the lenders have more slots than are borrowed, and the clock never moves
+				queues := make([]QueueConfig, len(tt.weights)+1)
+				for i, weight := range tt.weights {
+					queues[i] = QueueConfig{Rate: borrows, Weight: weight}
+				}
+				top := len(tt.weights)
+				queues[top] = QueueConfig{Weight: 1}
+
+				blitz := newTestBlitz(t, WithClock(newFakeClock()), WithQueueConfigs(queues), WithRefill(time.Second))
+
+				for i := 0; i < borrows; i++ {
+					switch mode {
+					case "reserve":
+						r, queue := blitz.reserveWeighted(top, 1)
+						if r == nil || queue == top || r.DelayFrom(blitz.clock.Now()) != 0 {
+							t.Fatalf("reserveWeighted() = queue %d, want an immediate slot of a lender", queue)
+						}
+					case "allow":
+						if !blitz.Allow(top) {
+							t.Fatal("Allow() = false, want true")
+						}
+					}
+				}
+
+				for i, want := range tt.want {
+					if got := blitz.borrowed[i].Load(); got != uint64(want) {
+						t.Errorf("queue %d lent %d slots, want %d", i, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestUseReservationSkew(t *testing.T) {
+	const skew = DefaultClockSkew
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		from, until time.Duration // validity of the token, relative to now
+
+		wantExpired bool
+	}{
+		{"barely early", nil, skew - time.Millisecond, skew + time.Second, false},
+		{"barely late", nil, -time.Second, -skew + time.Millisecond, false},
+		{"late by the skew", nil, -time.Second, -skew, true},
+		{"late beyond the skew", nil, -time.Second, -skew - time.Millisecond, true},
+		{"late without skew", []Option{WithClockSkew(0)}, -time.Second, -time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			blitz := newTestBlitz(t, append(tt.opts, WithClock(clock))...)
+
+			now := clock.Now()
+			encoded, err := blitz.signer.Encode(token{From: now.Add(tt.from), Until: now.Add(tt.until)})
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+
+			// the context is done, so that the test fails rather than hangs if the request is held
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err = blitz.useReservation(ctx, encoded, -1, binding{}, "client")
+			var expired errReservationExpired
+			switch {
+			case tt.wantExpired && !errors.As(err, &expired):
+				t.Errorf("useReservation() error = %v, want it to be expired", err)
+			case !tt.wantExpired && err != nil:
+				t.Errorf("useReservation() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestUseReservationCancelled(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline bool
+
+		wantStatus int
+		wantCode   string
+	}{
+		{"cancelled", false, DefaultCancelStatus, CodeCancelled},
+		{"deadline passed", true, http.StatusRequestTimeout, CodeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			var logs bytes.Buffer
+			blitz := newTestBlitz(t, WithClock(clock), WithLogger(log.New(&logs, "", 0)))
+
+			// a reservation only valid in a second, so the request waits for it
+			now := clock.Now()
+			encoded, err := blitz.signer.Encode(token{From: now.Add(time.Second), Until: now.Add(2 * time.Second)})
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+
+			w, body := sendRequestContext(t, blitz, doneContext(tt.deadline), map[string]string{HeaderReservation: encoded})
+			if w.Code != tt.wantStatus || body.Code != tt.wantCode {
+				t.Errorf("response = %d %q, want %d %q", w.Code, body.Code, tt.wantStatus, tt.wantCode)
+			}
+			if strings.Contains(logs.String(), "bad reservation") {
+				t.Errorf("logs = %q, want no bad reservation", logs.String())
+			}
+		})
+	}
+}
+
+func TestUseReservationQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		queue   int // queue the reservation was issued for
+		claimed int
+
+		wantErr bool
+	}{
+		{"unclaimed lowest", 0, -1, false},
+		{"unclaimed highest", 2, -1, false},
+		{"same queue", 1, 1, false},
+		{"higher queue", 0, 2, false},
+		{"lower queue", 1, 0, true},
+		{"lowest queue", 2, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			blitz := newTestBlitz(t, WithClock(clock), WithQueues([]uint64{1, 1, 1}))
+
+			now := clock.Now()
+			encoded, err := blitz.signer.Encode(token{Queue: tt.queue, From: now, Until: now.Add(time.Second)})
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+
+			_, err = blitz.useReservation(context.Background(), encoded, tt.claimed, binding{}, "client")
+			var queueErr errReservationQueue
+			if got := errors.As(err, &queueErr); got != tt.wantErr {
+				t.Errorf("useReservation() error = %v, want a queue error: %t", err, tt.wantErr)
+			}
+			if err != nil && !tt.wantErr {
+				t.Errorf("useReservation() error = %v, want nil", err)
+			}
+		})
+	}
+
+	// the header claims the queue of requests using a reservation
+	blitz := newTestBlitz(t, WithQueues([]uint64{1, 1}))
+	_, rs := requestReservation(t, blitz, map[string]string{HeaderQueue: "1"})
+	if !rs.Success || rs.Queue != 1 {
+		t.Fatalf("reservation = %q on queue %d, want a reservation on queue 1", rs.Code, rs.Queue)
+	}
+	for _, tt := range []struct {
+		headers  map[string]string
+		wantCode int
+	}{
+		{map[string]string{HeaderReservation: rs.XBlitzReservation}, http.StatusOK},
+		{map[string]string{HeaderReservation: rs.XBlitzReservation, HeaderQueue: "1"}, http.StatusOK},
+		{map[string]string{HeaderReservation: rs.XBlitzReservation, HeaderQueue: "0"}, http.StatusBadRequest},
+	} {
+		if w, body := sendRequest(t, blitz, tt.headers); w.Code != tt.wantCode {
+			t.Errorf("request with headers %v = %d %q, want %d", tt.headers, w.Code, body.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestUseReservationCancelledSingleUse(t *testing.T) {
+	clock := newFakeClock()
+	blitz := newTestBlitz(t, WithClock(clock), WithClockSkew(0), WithNonceStore(&MemoryNonceStore{}))
+
+	// a reservation only valid in a second, so the request waits for it
+	now := clock.Now()
+	encoded, err := blitz.signer.Encode(token{From: now.Add(time.Second), Until: now.Add(2 * time.Second)})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	headers := map[string]string{HeaderReservation: encoded}
+
+	// giving up while waiting does not use up the reservation
+	if w, body := sendRequestContext(t, blitz, doneContext(false), headers); w.Code != DefaultCancelStatus || body.Code != CodeCancelled {
+		t.Errorf("cancelled response = %d %q, want %d %q", w.Code, body.Code, DefaultCancelStatus, CodeCancelled)
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w, _ := sendRequest(t, blitz, headers)
+		done <- w
+	}()
+	for clock.Pending() == 0 && len(done) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	if w := <-done; w.Code != http.StatusOK {
+		t.Errorf("retried response = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// once used, it can not be used again
+	if w, body := sendRequest(t, blitz, headers); w.Code != http.StatusBadRequest || body.Code != CodeBadReservation {
+		t.Errorf("replayed response = %d %q, want %d %q", w.Code, body.Code, http.StatusBadRequest, CodeBadReservation)
+	}
+}
+
+func TestValidFromSlack(t *testing.T) {
+	const slack = 100 * time.Millisecond
+
+	tests := []struct {
+		name  string
+		slack time.Duration
+		used  int // slots used up before reserving
+
+		wantDelay    time.Duration
+		wantFromDiff time.Duration // valid from relative to the send time
+	}{
+		{"zero delay", slack, 0, 0, -slack},
+		{"zero delay without slack", 0, 0, 0, 0},
+		{"with delay", slack, 1, time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			blitz := newTestBlitz(t, WithClock(clock), WithClockSkew(0), WithValidFromSlack(tt.slack), WithQueues([]uint64{1}), WithRefill(time.Second))
+			for i := 0; i < tt.used; i++ {
+				blitz.Allow(0)
+			}
+
+			status, rs := requestReservation(t, blitz, nil)
+			if status != http.StatusOK || !rs.Success {
+				t.Fatalf("reservation = %d %q, want success", status, rs.Code)
+			}
+
+			now := clock.Now()
+			sendAt := time.UnixMilli(rs.SendAtUnixMilliseconds)
+			from := time.UnixMilli(rs.TokenValidFromUnixMilliseconds)
+			until := time.UnixMilli(rs.TokenValidUntilUnixMilliseconds)
+			if delay := time.Duration(rs.DelayInMilliseconds) * time.Millisecond; delay != tt.wantDelay || !sendAt.Equal(now.Add(tt.wantDelay)) {
+				t.Errorf("delay = %s, send at %s, want %s, %s", delay, sendAt, tt.wantDelay, now.Add(tt.wantDelay))
+			}
+			if diff := from.Sub(sendAt); diff != tt.wantFromDiff {
+				t.Errorf("valid from %s before sending, want %s", -diff, -tt.wantFromDiff)
+			}
+			if window := until.Sub(sendAt); window != time.Second || rs.WindowInMilliseconds != time.Second.Milliseconds() {
+				t.Errorf("window = %s, %dms, want %s", window, rs.WindowInMilliseconds, time.Second)
+			}
+			if tt.wantDelay != 0 {
+				return
+			}
+
+			// a reservation without a delay is usable right away, without being held
+			done := make(chan int, 1)
+			go func() {
+				w, _ := sendRequest(t, blitz, map[string]string{HeaderReservation: rs.XBlitzReservation})
+				done <- w.Code
+			}()
+			select {
+			case code := <-done:
+				if code != http.StatusOK {
+					t.Errorf("using the reservation = %d, want %d", code, http.StatusOK)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("reservation without a delay was held")
+			}
+		})
+	}
+}
+
+func TestReserveGreedy(t *testing.T) {
+	clock := newFakeClock()
+	blitz := newTestBlitz(t, WithClock(clock), WithQueues([]uint64{10, 0, 5, 1}), WithRefill(time.Second))
+	now := clock.Now()
+
+	// queue 3 is drained, queue 1 is closed, so queue 2 has the lowest delay and is the highest such queue
+	blitz.Allow(3)
+	if r, index := blitz.reserveGreedy(3, 1); index != 2 || r.DelayFrom(now) != 0 {
+		t.Fatalf("reserveGreedy() = queue %d, want queue 2 without a delay", index)
+	}
+
+	// more slots than queue 2 holds are only available in queue 0
+	if r, index := blitz.reserveGreedy(3, 6); index != 0 || r.DelayFrom(now) != 0 {
+		t.Errorf("reserveGreedy(6) = queue %d, want queue 0 without a delay", index)
+	}
+
+	// more slots than any queue holds are never available
+	if r, index := blitz.reserveGreedy(3, 11); r != nil || index != -1 {
+		t.Errorf("reserveGreedy(11) = queue %d, want none", index)
+	}
+
+	// a reservation with a higher delay than estimated, as if a concurrent request took the slots, is replaced
+	taken := blitz.limiters[3].ReserveN(now, 1)
+	r, index := blitz.reserveLowest(3, 1, now, taken, 3)
+	if index != 2 || r.DelayFrom(now) != 0 {
+		t.Errorf("reserveLowest() = queue %d delay %s, want queue 2 without a delay", index, r.DelayFrom(now))
+	}
+	if tokens := blitz.limiters[3].TokensAt(now); tokens != 0 {
+		t.Errorf("tokens of queue 3 = %g, want the replaced reservation to be cancelled", tokens)
+	}
+}
+
+func BenchmarkReserve(b *testing.B) {
+	for _, queues := range []int{1, 10, 1000} {
+		for _, depth := range []int{0, 4} {
+			if depth != 0 && depth >= queues {
+				continue
+			}
+			b.Run(fmt.Sprintf("queues=%d/depth=%d", queues, depth), func(b *testing.B) {
+				clock := newFakeClock()
+				rates := make([]uint64, queues)
+				for i := range rates {
+					rates[i] = 1
+				}
+				blitz := newTestBlitz(b, WithClock(clock), WithQueues(rates), WithRefill(time.Second), WithBorrowDepth(depth))
+
+				// drain all queues, so that requests on the highest queue look at every lower one
+				for i := range rates {
+					blitz.Allow(i)
+				}
+				now := clock.Now()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					r, _ := blitz.reserve(queues-1, 1)
+					r.CancelAt(now)
+				}
+			})
+		}
+	}
+}
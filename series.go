@@ -0,0 +1,104 @@
+package blitz
+
+import (
+	"errors"
+	"math/big"
+	"time"
+)
+
+var errInvalidSeriesName = errors.New("series name must be non-empty and consist of letters, digits and underscores only")
+
+// Series averages a single named metric for each queue, such as the size of admitted requests.
+// Values are held for the same window as the delays of the queue, see [WithStatsWindow] and [WithStatsCapacity].
+//
+// Series are created using [Blitz.RegisterSeries], and reported by [Blitz.Status] and the metrics handler.
+// They are safe for concurrent use.
+type Series struct {
+	name  string
+	stats []*Stats
+}
+
+// Name returns the name of the series.
+func (s *Series) Name() string {
+	return s.name
+}
+
+// Add adds a value for the given queue.
+// Values for queues that do not exist are ignored.
+func (s *Series) Add(queue int, value float64) {
+	if queue < 0 || queue >= len(s.stats) {
+		return
+	}
+	s.stats[queue].Add(big.NewFloat(value))
+}
+
+// AddDuration is like Add, but adds a duration in fractional milliseconds.
+func (s *Series) AddDuration(queue int, d time.Duration) {
+	s.Add(queue, float64(d)/float64(time.Millisecond))
+}
+
+// Stats returns the statistics of the given queue, or nil if it does not exist.
+func (s *Series) Stats(queue int) *Stats {
+	if queue < 0 || queue >= len(s.stats) {
+		return nil
+	}
+	return s.stats[queue]
+}
+
+// RegisterSeries registers a new series with the given name, or returns the existing one if the name is registered already.
+// Names are used as labels of the metrics, and may only consist of letters, digits and underscores.
+func (blitz *Blitz) RegisterSeries(name string) (*Series, error) {
+	if !validSeriesName(name) {
+		return nil, errInvalidSeriesName
+	}
+
+	blitz.seriesLock.Lock()
+	defer blitz.seriesLock.Unlock()
+
+	for _, s := range blitz.series {
+		if s.name == name {
+			return s, nil
+		}
+	}
+
+	s := &Series{name: name, stats: make([]*Stats, len(blitz.stats))}
+	for i, stats := range blitz.stats {
+		s.stats[i] = NewStatsWithClock(stats.Window(), blitz.statsCapacity, blitz.clock)
+	}
+	blitz.series = append(blitz.series, s)
+	return s, nil
+}
+
+// Series returns the series registered with the given name, or nil if there is none.
+func (blitz *Blitz) Series(name string) *Series {
+	blitz.seriesLock.RLock()
+	defer blitz.seriesLock.RUnlock()
+
+	for _, s := range blitz.series {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// allSeries returns all registered series, in the order they were registered.
+func (blitz *Blitz) allSeries() []*Series {
+	blitz.seriesLock.RLock()
+	defer blitz.seriesLock.RUnlock()
+
+	return blitz.series[:len(blitz.series):len(blitz.series)]
+}
+
+// validSeriesName checks if name is a valid name of a series.
+func validSeriesName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package blitz
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterSeries(t *testing.T) {
+	blitz := newTestBlitz(t, WithClock(newFakeClock()), WithQueues([]uint64{1, 1}))
+
+	for _, name := range []string{"", "size in bytes", "size-bytes", "größe"} {
+		if _, err := blitz.RegisterSeries(name); !errors.Is(err, errInvalidSeriesName) {
+			t.Errorf("RegisterSeries(%q) error = %v, want %v", name, err, errInvalidSeriesName)
+		}
+	}
+
+	series, err := blitz.RegisterSeries("size_bytes")
+	if err != nil {
+		t.Fatalf("RegisterSeries() error = %v", err)
+	}
+	if again, _ := blitz.RegisterSeries("size_bytes"); again != series {
+		t.Error("registering a name twice returned a different series")
+	}
+	if got := blitz.Series("size_bytes"); got != series {
+		t.Error("Series() did not return the registered series")
+	}
+	if got := blitz.Series("unknown"); got != nil {
+		t.Errorf("Series(%q) = %v, want nil", "unknown", got)
+	}
+
+	series.Add(1, 2)
+	series.Add(1, 4)
+	series.AddDuration(0, 1500*time.Microsecond)
+	series.Add(-1, 100)
+	series.Add(2, 100)
+
+	if average, _ := series.Stats(1).Average().Float64(); average != 3 {
+		t.Errorf("average of queue 1 = %g, want 3", average)
+	}
+	if series.Stats(2) != nil {
+		t.Error("Stats() of a queue that does not exist is not nil")
+	}
+
+	blitz.Series(SeriesBackendLatency).Add(0, 4)
+	blitz.Series(SeriesBackendTTFB).Add(0, 2)
+
+	st := blitz.Status()
+	if got := st.Queues[0].Series["size_bytes"]; got != 1.5 {
+		t.Errorf("status of queue 0 = %g, want 1.5", got)
+	}
+
+	// the built-in series are only reported in their own fields
+	if got := st.Queues[0]; got.BackendLatencyMs != 4 || got.BackendTTFBMs != 2 {
+		t.Errorf("backend latency = %g, ttfb = %g, want 4, 2", got.BackendLatencyMs, got.BackendTTFBMs)
+	}
+	if got := len(st.Queues[0].Series); got != 1 {
+		t.Errorf("status of queue 0 has %d series, want 1: %v", got, st.Queues[0].Series)
+	}
+
+	w := httptest.NewRecorder()
+	blitz.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := `blitz_series_average{series="size_bytes",queue="1"} 3`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("metrics do not contain %q", want)
+	}
+
+	blitz.ResetStats()
+	if count := series.Stats(1).Count(); count != 0 {
+		t.Errorf("count after ResetStats() = %d, want 0", count)
+	}
+}
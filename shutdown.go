@@ -0,0 +1,101 @@
+package blitz
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var errClosed = errors.New("server is shutting down")
+
+// Shutdown gracefully shuts down the server.
+// New requests are rejected with [net/http.StatusServiceUnavailable], while requests already waiting are still forwarded.
+//
+// Shutdown waits for all waiting and forwarded requests to complete, or the context to be done, whichever happens first.
+// In the latter case, the error of the context is returned.
+// It is intended to be called alongside [net/http.Server.Shutdown].
+func (blitz *Blitz) Shutdown(ctx context.Context) error {
+	blitz.lifecycle.Lock()
+	blitz.draining = true
+	blitz.lifecycle.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		blitz.requests.Wait()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close immediately shuts down the server.
+// New requests are rejected, and requests that are still waiting are rejected with [net/http.StatusServiceUnavailable].
+// Requests already forwarded to the handler are not affected.
+func (blitz *Blitz) Close() error {
+	blitz.lifecycle.Lock()
+	blitz.draining = true
+	blitz.lifecycle.Unlock()
+
+	blitz.closeOnce.Do(func() { close(blitz.closed) })
+	return nil
+}
+
+// enter registers a new request to be waited for by Shutdown.
+// If the server is shutting down, returns false and does not register the request.
+func (blitz *Blitz) enter() bool {
+	blitz.lifecycle.Lock()
+	defer blitz.lifecycle.Unlock()
+
+	if blitz.draining {
+		return false
+	}
+	blitz.requests.Add(1)
+	return true
+}
+
+// leave marks a request registered with enter as completed.
+func (blitz *Blitz) leave() {
+	blitz.requests.Done()
+}
+
+// isDraining checks if the server is shutting down.
+func (blitz *Blitz) isDraining() bool {
+	blitz.lifecycle.Lock()
+	defer blitz.lifecycle.Unlock()
+
+	return blitz.draining
+}
+
+// wait waits for the given duration.
+// If the context is done or the server is closed first, returns an error.
+//
+// A duration of zero or less returns immediately, without creating a timer.
+// Otherwise, the timer is stopped when returning early, so that abandoned waits do not hold on to it for the whole duration.
+func (blitz *Blitz) wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer, stop := blitz.clock.NewTimer(d)
+	defer stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-blitz.closed:
+		return errClosed
+	case <-timer:
+		return nil
+	}
+}
+
+// serveUnavailable rejects a request because the server is shutting down.
+func (blitz *Blitz) serveUnavailable(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "Service Unavailable", 0)
+}
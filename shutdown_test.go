@@ -0,0 +1,48 @@
+package blitz
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	clock := newFakeClock()
+	blitz := newTestBlitz(t, WithClock(clock))
+
+	t.Run("elapsed", func(t *testing.T) {
+		done := make(chan error)
+		go func() { done <- blitz.wait(context.Background(), time.Second) }()
+
+		for clock.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(time.Second)
+
+		if err := <-done; err != nil {
+			t.Errorf("wait() error = %v, want nil", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := blitz.wait(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+			t.Errorf("wait() error = %v, want %v", err, context.Canceled)
+		}
+		if pending := clock.Pending(); pending != 0 {
+			t.Errorf("wait() left %d timers running, want 0", pending)
+		}
+	})
+
+	t.Run("zero", func(t *testing.T) {
+		if err := blitz.wait(context.Background(), 0); err != nil {
+			t.Errorf("wait() error = %v, want nil", err)
+		}
+		if pending := clock.Pending(); pending != 0 {
+			t.Errorf("wait() left %d timers, want none for a zero delay", pending)
+		}
+	})
+}
@@ -1,86 +1,269 @@
 package blitz
 
 import (
+	"bytes"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"time"
+	"io/fs"
+	"net/http"
+	"os"
+	"runtime"
 
 	"golang.org/x/crypto/nacl/sign"
 )
 
-// signer uses a keypair to encode and decode messages
-type signer struct {
+// signer encodes and decodes reservation tokens
+type signer interface {
+	// Encode encodes and signs the given token.
+	// If the token can not be signed, returns an error.
+	Encode(t token) (string, error)
+
+	// Decode attempts to decode the given string into a token with times as UTC.
+	// If the token is invalid, returns an error.
+	Decode(encoded string) (token, error)
+}
+
+// naclSigner is a signer that uses a nacl keypair to sign tokens
+type naclSigner struct {
 	pubKey  *[32]byte
 	privKey *[64]byte
+
+	// additional public keys to accept messages from, such as previous keys during a key rotation
+	verifyKeys []*[32]byte
+}
+
+// AddVerifyKey additionally accepts messages signed with the private key belonging to the given public key.
+func (s *naclSigner) AddVerifyKey(pub *[32]byte) {
+	s.verifyKeys = append(s.verifyKeys, pub)
+}
+
+var errHMACWithKeyFile = errors.New("an hmac key can not be combined with key files or verify keys")
+
+// newSigner creates the signer configured for this Blitz.
+func (blitz *Blitz) newSigner() (signer, error) {
+	if blitz.hmacKey != nil {
+		if blitz.remoteSigner != nil {
+			return nil, errRemoteWithKeyFile
+		}
+		if blitz.keyFile != "" || len(blitz.verifyKeys) > 0 || len(blitz.verifyKeyFiles) > 0 {
+			return nil, errHMACWithKeyFile
+		}
+		return newHMACSigner(blitz.hmacKey, blitz.hmacTagLength)
+	}
+
+	var (
+		s   *naclSigner
+		err error
+	)
+	switch {
+	case blitz.remoteSigner != nil:
+		if blitz.keyFile != "" {
+			return nil, errRemoteWithKeyFile
+		}
+		pub := blitz.remoteSigner.PublicKey()
+		s = &naclSigner{pubKey: &pub}
+	case blitz.keyFile != "":
+		s, err = loadOrCreateSigner(blitz.keyFile, blitz.rand)
+	default:
+		s, err = newSigner(blitz.rand)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range blitz.verifyKeyFiles {
+		verify, err := loadSigner(path)
+		if err != nil {
+			return nil, err
+		}
+		blitz.verifyKeys = append(blitz.verifyKeys, *verify.pubKey)
+	}
+	for i := range blitz.verifyKeys {
+		s.AddVerifyKey(&blitz.verifyKeys[i])
+	}
+
+	if blitz.remoteSigner != nil {
+		return &remoteSigner{naclSigner: s, remote: blitz.remoteSigner, timeout: DefaultSignTimeout}, nil
+	}
+	return s, nil
 }
 
 // newSigner creates a new signer from a random reader.
 // rand is only used to initialize the keypair, and no longer needed afterwards.
-func newSigner(rand io.Reader) (signer, error) {
+func newSigner(rand io.Reader) (*naclSigner, error) {
 	puk, pik, err := sign.GenerateKey(rand)
 	if err != nil {
-		return signer{}, err
+		return nil, err
 	}
 
-	var s signer
-	s.pubKey = puk
-	s.privKey = pik
-
-	return s, nil
+	return &naclSigner{pubKey: puk, privKey: pik}, nil
 }
 
 var (
-	errInvalidFormat    = errors.New("invalid signature format")
-	errInvalidSignature = errors.New("invalid signature")
+	errInvalidKeyFile     = errors.New("invalid key file")
+	errInsecureKeyFile    = errors.New("key file must not be accessible by group or others")
+	errKeyFileMismatching = errors.New("key file contains mismatching public and private keys")
 )
 
-var (
-	messageLength   = 2 * (64 / 8)                                   // length of the reservation, 3 bytes of 64 ints
-	signatureLength = messageLength + sign.Overhead                  // length of message + signature
-	encodedLength   = base64.StdEncoding.EncodedLen(signatureLength) // length of base64
-)
+// keyFileLength is the length of a key file, containing the public key followed by the private key.
+const keyFileLength = 32 + 64
 
-// Encode encodes and signs a signature for the given two times as UTC.
-func (s *signer) Encode(from, until time.Time) string {
-	// store from and until
-	message := make([]byte, messageLength)
-	binary.LittleEndian.PutUint64(message[0:8], uint64(from.UTC().UnixMilli()))
-	binary.LittleEndian.PutUint64(message[8:16], uint64(until.UTC().UnixMilli()))
+// loadOrCreateSigner loads a signer from the key file at path.
+// If the file does not exist, creates a new signer using rand and saves it to path.
+func loadOrCreateSigner(path string, rand io.Reader) (*naclSigner, error) {
+	s, err := loadSigner(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return s, err
+	}
 
-	// sign the message with the private key
-	signature := make([]byte, 0, signatureLength)
-	signature = sign.Sign(signature, message, s.privKey)
+	s, err = newSigner(rand)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	// encode in base64
-	return base64.StdEncoding.EncodeToString(signature)
+// loadSigner loads a signer from the key file at path.
+func loadSigner(path string) (*naclSigner, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// ensure that nobody else can read the private key
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("%w: %q has mode %s", errInsecureKeyFile, path, info.Mode().Perm())
+	}
+
+	// read the keys
+	data, err := io.ReadAll(io.LimitReader(file, keyFileLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != keyFileLength {
+		return nil, errInvalidKeyFile
+	}
+
+	s := &naclSigner{pubKey: new([32]byte), privKey: new([64]byte)}
+	copy(s.pubKey[:], data[:32])
+	copy(s.privKey[:], data[32:])
+
+	// the private key contains the public key
+	if !bytes.Equal(s.privKey[32:], s.pubKey[:]) {
+		return nil, errKeyFileMismatching
+	}
+	return s, nil
 }
 
-// Decode attempts to decode the given token into two times from and until as UTC.
-// If the times are invalid, returns an error.
-func (s *signer) Decode(token string) (from, until time.Time, err error) {
-	if len(token) != encodedLength {
-		return from, until, errInvalidFormat
+// save saves the keypair of this signer to a new key file at path.
+// The file is only readable by the current user.
+func (s *naclSigner) save(path string) error {
+	data := make([]byte, 0, keyFileLength)
+	data = append(data, s.pubKey[:]...)
+	data = append(data, s.privKey[:]...)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
 	}
+	return file.Close()
+}
+
+// naclSignatureLength is the length of a message signed by a naclSigner
+var naclSignatureLength = messageLength + sign.Overhead
+
+// Encode implements signer.
+func (s *naclSigner) Encode(t token) (string, error) {
+	// sign the message with the private key
+	signature := make([]byte, 0, naclSignatureLength)
+	signature = sign.Sign(signature, t.marshal(), s.privKey)
 
-	// do the decode!
-	signed, err := base64.StdEncoding.DecodeString(token)
+	return encodeSigned(signature), nil
+}
+
+// Decode implements signer.
+func (s *naclSigner) Decode(encoded string) (t token, err error) {
+	signed, err := decodeSigned(encoded)
 	if err != nil {
-		return from, until, errInvalidFormat
+		return t, err
 	}
 
-	// verify the message
-	message := make([]byte, 0, messageLength)
-	var valid bool
-	message, valid = sign.Open(message, signed, s.pubKey)
+	// verify the message with each accepted key
+	message, valid := sign.Open(make([]byte, 0, messageLength), signed, s.pubKey)
+	for _, key := range s.verifyKeys {
+		if valid {
+			break
+		}
+		message, valid = sign.Open(message[:0], signed, key)
+	}
 	if !valid {
-		return from, until, errInvalidSignature
+		return t, errInvalidSignature
+	}
+
+	// re-create the token
+	if err := t.unmarshal(message); err != nil {
+		return t, err
 	}
+	return t, nil
+}
+
+// unverifiedMessage implements queueKeySigner.
+func (s *naclSigner) unverifiedMessage(signed []byte) ([]byte, bool) {
+	if len(signed) < sign.Overhead {
+		return nil, false
+	}
+	return signed[sign.Overhead:], true
+}
 
-	// re-create the time objects
-	from = time.UnixMilli(int64(binary.LittleEndian.Uint64(message[0:8]))).UTC()
-	until = time.UnixMilli(int64(binary.LittleEndian.Uint64(message[8:16]))).UTC()
+// publicKeyPath is the path of the public key endpoint, relative to the control path.
+const publicKeyPath = "pubkey"
+
+// PublicKey returns the public key used to verify reservations, allowing other services to verify them.
+// Reservations are the url-safe base64 encoding, without padding, of a message signed using [golang.org/x/crypto/nacl/sign].
+//
+// If reservations are not signed with a single keypair, for example when using [WithHMACKey] or [WithPerQueueKeys], returns false.
+func (blitz *Blitz) PublicKey() ([32]byte, bool) {
+	s := blitz.signer
+	if cs, ok := s.(*cachingSigner); ok {
+		s = cs.signer
+	}
+
+	switch s := s.(type) {
+	case *naclSigner:
+		return *s.pubKey, true
+	case *remoteSigner:
+		return *s.pubKey, true
+	default:
+		return [32]byte{}, false
+	}
+}
+
+// servePublicKey serves the public key as url-safe base64 without padding.
+func (blitz *Blitz) servePublicKey(w http.ResponseWriter, r *http.Request) {
+	key, ok := blitz.PublicKey()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		serveMethodNotAllowed(w, r)
+		return
+	}
 
-	return from, until, nil
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, base64.RawURLEncoding.EncodeToString(key[:]))
 }
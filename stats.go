@@ -1,27 +1,71 @@
 package blitz
 
 import (
+	"math"
 	"math/big"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Stats averages a set of values over the last period d.
 // The zero value is not ready for use, see [NewStats].
 type Stats struct {
-	d time.Duration
+	d     time.Duration
+	clock Clock
 
 	m         sync.Mutex // held when writing
 	lastPurge time.Time
 
-	// entries added, guaranteed to be weakly monotone
-	entries []statElement
+	// entries added, guaranteed to be weakly monotone.
+	// stored in a ring buffer of count elements starting at head.
+	entries     []statElement
+	head, count int
+	capacity    int // maximum number of entries, 0 if unbounded
+
+	// sum of all entries, maintained as entries are added and dropped
+	sum big.Float
+
+	// snapshot of the sum and count, published after every change.
+	// it allows reading them without holding the mutex.
+	snapshot atomic.Pointer[statsSnapshot]
+}
+
+// sumPrecision is the precision of the running sum.
+// It is large enough to exactly hold the sum of many int64 values, so that dropping entries does not accumulate rounding errors.
+const sumPrecision = 512
+
+// statsSnapshot is an immutable snapshot of the sum and count of a [Stats].
+type statsSnapshot struct {
+	sum    big.Float
+	count  int
+	oldest time.Time // time of the oldest entry, if any
 }
 
 // NewStats creates a new stats object that holds statistics for the given duration.
 func NewStats(d time.Duration) *Stats {
-	return &Stats{d: d, lastPurge: time.Now()}
+	return NewStatsWithCapacity(d, 0)
+}
+
+// NewStatsWithCapacity is like [NewStats], but holds at most capacity values.
+// Once full, adding a new value overwrites the oldest one.
+// A capacity of zero or less means unbounded.
+func NewStatsWithCapacity(d time.Duration, capacity int) *Stats {
+	return NewStatsWithClock(d, capacity, realClock{})
+}
+
+// NewStatsWithClock is like [NewStatsWithCapacity], but uses the given clock to tell when values were added.
+func NewStatsWithClock(d time.Duration, capacity int, clock Clock) *Stats {
+	s := &Stats{d: d, clock: clock, lastPurge: clock.Now(), capacity: max(capacity, 0)}
+	s.sum.SetPrec(sumPrecision)
+	s.publish()
+	return s
+}
+
+// Window returns the duration statistics are held for.
+func (s *Stats) Window() time.Duration {
+	return s.d
 }
 
 type statElement struct {
@@ -29,33 +73,59 @@ type statElement struct {
 	value big.Float
 }
 
+// at returns the ith entry, with the oldest entry at index 0.
+func (s *Stats) at(i int) *statElement {
+	return &s.entries[(s.head+i)%len(s.entries)]
+}
+
 // purge purges invalid elements.
 func (s *Stats) purge() {
 	// instance entries are valid until
-	s.lastPurge = time.Now()
+	s.lastPurge = s.clock.Now()
 
-	// get the first valid index
-	validIndex := slices.IndexFunc(s.entries, func(se statElement) bool {
-		return s.lastPurge.Sub(se.time) <= s.d
-	})
+	// drop the oldest entries until the first valid one
+	for s.count > 0 && s.lastPurge.Sub(s.at(0).time) > s.d {
+		s.dropOldest()
+	}
+	s.publish()
+}
 
-	switch {
-	// nothing is valid
-	case validIndex == -1:
-		s.entries = s.entries[:0]
-
-	// there are some invalid indexes
-	case validIndex > 0:
-		// move the entries to the left
-		count := copy(s.entries, s.entries[validIndex:])
-		s.entries = s.entries[:count]
+// dropOldest drops the oldest entry, which must exist.
+func (s *Stats) dropOldest() {
+	s.sum.Sub(&s.sum, &s.at(0).value)
+	s.head = (s.head + 1) % len(s.entries)
+	s.count--
+}
+
+// publish publishes a snapshot of the current sum and count.
+func (s *Stats) publish() {
+	snapshot := &statsSnapshot{count: s.count}
+	snapshot.sum.Set(&s.sum)
+	if s.count > 0 {
+		snapshot.oldest = s.at(0).time
+	}
+	s.snapshot.Store(snapshot)
+}
+
+// current returns a snapshot of the sum and count of the values added over the past d duration.
+// Unless some values have expired since the last snapshot, it does not block.
+func (s *Stats) current() *statsSnapshot {
+	snapshot := s.snapshot.Load()
+	if snapshot != nil && (snapshot.count == 0 || s.clock.Now().Sub(snapshot.oldest) <= s.d) {
+		return snapshot
 	}
 
+	// some values have expired => purge them
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.purge()
+	return s.snapshot.Load()
 }
 
 // Add adds a new value to be averaged for the current time.
 func (s *Stats) Add(value *big.Float) {
-	s.add(func(new *big.Float) { value.Set(value) })
+	s.add(func(new *big.Float) { new.Set(value) })
 }
 
 // AddInt64 is like Add, but takes an int64
@@ -67,39 +137,164 @@ func (s *Stats) add(f func(value *big.Float)) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	s.entries = append(s.entries, statElement{
-		time: time.Now(),
-	})
-	f(&s.entries[len(s.entries)-1].value)
+	// make space for the new element
+	switch {
+	case s.capacity > 0 && s.count == s.capacity:
+		// full => overwrite the oldest element
+		s.dropOldest()
+	case s.count == len(s.entries):
+		// no space left => grow the buffer
+		s.grow()
+	}
+
+	// keep entries weakly monotone, even if the clock stepped backward
+	now := s.clock.Now()
+	if s.count > 0 {
+		if newest := s.at(s.count - 1).time; now.Before(newest) {
+			now = newest
+		}
+	}
+
+	element := s.at(s.count)
+	s.count++
 
-	if time.Since(s.lastPurge) > s.d {
+	element.time = now
+	f(&element.value)
+	s.sum.Add(&s.sum, &element.value)
+
+	if now.Sub(s.lastPurge) > s.d || now.Before(s.lastPurge) {
 		s.purge()
+		return
 	}
+	s.publish()
 }
 
-// Average returns the average values added over the past d duration.
-func (s *Stats) Average() *big.Float {
+// Reset discards all values added so far.
+func (s *Stats) Reset() {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	s.purge()
+	s.entries = nil
+	s.head, s.count = 0, 0
+	s.sum.SetInt64(0)
+	s.lastPurge = s.clock.Now()
+	s.publish()
+}
+
+// grow grows the ring buffer, moving the oldest entry to index 0.
+func (s *Stats) grow() {
+	size := max(2*len(s.entries), 1)
+	if s.capacity > 0 {
+		size = min(size, s.capacity)
+	}
+
+	entries := make([]statElement, size)
+	for i := 0; i < s.count; i++ {
+		entries[i] = *s.at(i)
+	}
+
+	s.entries = entries
+	s.head = 0
+}
+
+// Average returns the average values added over the past d duration.
+// It does not block concurrent calls to Add, unless values have expired since they were last purged.
+func (s *Stats) Average() *big.Float {
+	snapshot := s.current()
 
 	// get the total number of entries
 	var total big.Float
-	if len(s.entries) == 0 {
+	if snapshot.count == 0 {
 		return &total
 	}
-	total.SetInt64(int64(len(s.entries)))
+	total.SetInt64(int64(snapshot.count))
 
-	// sum all the numbers
-	var result big.Float
-	for _, e := range s.entries {
-		result.Add(&result, &e.value)
+	// divide the sum by the total
+	return new(big.Float).Quo(&snapshot.sum, &total)
+}
+
+// Sum returns the sum of the values added over the past d duration.
+func (s *Stats) Sum() *big.Float {
+	return new(big.Float).Set(&s.current().sum)
+}
+
+// Count returns the number of values added over the past d duration.
+func (s *Stats) Count() int {
+	return s.current().count
+}
+
+// Percentile returns the p-th percentile (with 0 <= p <= 100) of the values added over the past d duration.
+// It uses the nearest-rank method, returning zero if there are no values.
+func (s *Stats) Percentile(p float64) *big.Float {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.purge()
+
+	if s.count == 0 {
+		return new(big.Float)
 	}
 
-	// divide by the total
-	result.Quo(&result, &total)
+	// sort a copy of all values
+	values := make([]*big.Float, s.count)
+	for i := range values {
+		values[i] = &s.at(i).value
+	}
+	slices.SortFunc(values, func(a, b *big.Float) int {
+		return a.Cmp(b)
+	})
+
+	// find the nearest rank
+	rank := int(math.Ceil(p / 100 * float64(len(values))))
+	rank = min(max(rank, 1), len(values))
+
+	return new(big.Float).Set(values[rank-1])
+}
+
+// Max returns the largest value added over the past d duration, or zero if there are none.
+func (s *Stats) Max() *big.Float {
+	return s.extreme(1)
+}
+
+// Min returns the smallest value added over the past d duration, or zero if there are none.
+func (s *Stats) Min() *big.Float {
+	return s.extreme(-1)
+}
 
-	// and return
+// extreme returns the value v that satisfies v.Cmp(other) == sign for all other values.
+func (s *Stats) extreme(sign int) *big.Float {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.purge()
+
+	var result big.Float
+	for i := 0; i < s.count; i++ {
+		if value := &s.at(i).value; i == 0 || value.Cmp(&result) == sign {
+			result.Set(value)
+		}
+	}
 	return &result
 }
+
+// Sample is a single value held by a [Stats].
+type Sample struct {
+	Time  time.Time  // time the value was added at
+	Value *big.Float // the value itself
+}
+
+// Samples returns a copy of the values added over the past d duration, oldest first.
+// It allows computing statistics not provided by [Stats] itself.
+func (s *Stats) Samples() []Sample {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.purge()
+
+	samples := make([]Sample, s.count)
+	for i := range samples {
+		element := s.at(i)
+		samples[i] = Sample{Time: element.time, Value: new(big.Float).Set(&element.value)}
+	}
+	return samples
+}
@@ -0,0 +1,154 @@
+package blitz
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsClockStep(t *testing.T) {
+	clock := newFakeClock()
+	stats := NewStatsWithClock(10*time.Second, 0, clock)
+	start := clock.Now()
+
+	stats.AddInt64(1)
+	clock.Advance(5 * time.Second)
+	stats.AddInt64(2)
+
+	// step back before the first value, and keep adding
+	clock.Set(start.Add(-time.Minute))
+	stats.AddInt64(3)
+	stats.AddInt64(6)
+
+	if count := stats.Count(); count != 4 {
+		t.Errorf("Count() after step = %d, want 4", count)
+	}
+	if average, _ := stats.Average().Float64(); average != 3 {
+		t.Errorf("Average() after step = %g, want 3", average)
+	}
+
+	// values added while behind count as added at the latest time seen, so they expire with it
+	clock.Set(start.Add(11 * time.Second))
+	if count := stats.Count(); count != 3 {
+		t.Errorf("Count() after the first value expired = %d, want 3", count)
+	}
+	clock.Set(start.Add(16 * time.Second))
+	if count := stats.Count(); count != 0 {
+		t.Errorf("Count() after all values expired = %d, want 0", count)
+	}
+}
+
+func TestStatsAddFloat(t *testing.T) {
+	stats := NewStats(10 * time.Second)
+
+	stats.Add(big.NewFloat(1.5))
+	stats.Add(big.NewFloat(2.5))
+
+	average, _ := stats.Average().Float64()
+	if average == 0 {
+		t.Fatal("Average() = 0, want the average of the added values")
+	}
+	if average != 2 {
+		t.Errorf("Average() = %g, want 2", average)
+	}
+}
+
+// mutexStats is the reference implementation that Stats replaced.
+// It holds a fixed number of values, and sums all of them under its mutex whenever the average is read.
+type mutexStats struct {
+	m      sync.Mutex
+	values []big.Float
+	head   int
+}
+
+func (s *mutexStats) AddInt64(value int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.values[s.head].SetInt64(value)
+	s.head = (s.head + 1) % len(s.values)
+}
+
+func (s *mutexStats) Average() *big.Float {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var result, total big.Float
+	for i := range s.values {
+		result.Add(&result, &s.values[i])
+	}
+	total.SetInt64(int64(len(s.values)))
+	return result.Quo(&result, &total)
+}
+
+// averager is implemented by both Stats and mutexStats.
+type averager interface {
+	AddInt64(value int64)
+	Average() *big.Float
+}
+
+// fullAveragers returns both implementations holding size values, which stay at that size as further values are added.
+func fullAveragers(size int) map[string]averager {
+	stats := NewStatsWithCapacity(time.Hour, size)
+	reference := &mutexStats{values: make([]big.Float, size)}
+	for i := 0; i < size; i++ {
+		stats.AddInt64(int64(i))
+		reference.AddInt64(int64(i))
+	}
+	return map[string]averager{"stats": stats, "mutex": reference}
+}
+
+// benchmarkConcurrent runs op in parallel while another goroutine keeps calling background, until op ran b.N times.
+func benchmarkConcurrent(b *testing.B, background, op func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				background()
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			op()
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	<-stopped
+}
+
+// BenchmarkStatsAverage measures reading the average while values are added concurrently.
+func BenchmarkStatsAverage(b *testing.B) {
+	for _, size := range []int{100, 10000} {
+		for _, impl := range []string{"stats", "mutex"} {
+			b.Run(fmt.Sprintf("impl=%s/size=%d", impl, size), func(b *testing.B) {
+				stats := fullAveragers(size)[impl]
+				benchmarkConcurrent(b, func() { stats.AddInt64(1) }, func() { stats.Average() })
+			})
+		}
+	}
+}
+
+// BenchmarkStatsAdd measures adding values while the average is read concurrently.
+func BenchmarkStatsAdd(b *testing.B) {
+	for _, size := range []int{100, 10000} {
+		for _, impl := range []string{"stats", "mutex"} {
+			b.Run(fmt.Sprintf("impl=%s/size=%d", impl, size), func(b *testing.B) {
+				stats := fullAveragers(size)[impl]
+				benchmarkConcurrent(b, func() { stats.Average() }, func() { stats.AddInt64(1) })
+			})
+		}
+	}
+}
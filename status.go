@@ -0,0 +1,144 @@
+package blitz
+
+import (
+	"math"
+	"math/big"
+	"time"
+)
+
+type Status struct {
+	// name of each queue, empty for queues without a name
+	Names []string
+
+	Slots     []int64
+	Delays    []int64
+	P95Delays []int64
+
+	// average delay of each queue in fractional milliseconds, unlike Delays which truncates to whole milliseconds
+	DelaysFloat []float64
+
+	// duration delays are averaged over for each queue, in milliseconds
+	StatsWindows []int64
+
+	// number of reservations issued and used for each queue
+	ReservationsIssued []int64
+	ReservationsUsed   []int64
+
+	// number of requests of each queue currently being handled
+	Concurrent []int64
+
+	// status of each queue, holding the same values as the slices above.
+	// new per-queue values are only added here.
+	Queues []QueueStatus
+}
+
+// QueueStatus is the status of a single queue.
+type QueueStatus struct {
+	Index int    // index of the queue
+	Name  string // name of the queue, empty if it has none
+
+	Slots int64 // number of available slots
+
+	AvgDelayMs    float64 // average delay in fractional milliseconds
+	P95Ms         int64   // 95th percentile of the delay in milliseconds
+	StatsWindowMs int64   // duration delays are averaged over, in milliseconds
+
+	ReservationsIssued int64 // number of reservations issued
+	ReservationsUsed   int64 // number of reservations used
+
+	Concurrent  int64 // number of requests currently being handled
+	QueueLength int64 // number of requests without a reservation currently waiting for their delay
+
+	BackendLatencyMs float64 // average time taken by the handler to serve forwarded requests, in fractional milliseconds
+	BackendTTFBMs    float64 // average time until the handler starts responding to forwarded requests, in fractional milliseconds
+
+	Series map[string]float64 // average of each series registered using [Blitz.RegisterSeries], by name; the latencies above are not repeated
+}
+
+func (blitz *Blitz) Status() (st Status) {
+	st.Names = make([]string, len(blitz.queues))
+	for i := range blitz.queues {
+		st.Names[i] = blitz.queues[i].Name
+	}
+
+	// compute available slots for each queue
+	now := blitz.clock.Now()
+	st.Slots = make([]int64, len(blitz.limiters))
+	for i, l := range blitz.limiters {
+		st.Slots[i] = int64(math.Floor(l.TokensAt(now)))
+	}
+
+	// compute the average delay for each queue
+	st.Delays = make([]int64, len(blitz.limiters))
+	st.DelaysFloat = make([]float64, len(blitz.limiters))
+	for i, s := range blitz.stats {
+		average := s.Average()
+		a, _ := average.Int64()
+		st.Delays[i] = time.Duration(a).Milliseconds()
+
+		ms, _ := new(big.Float).Quo(average, big.NewFloat(float64(time.Millisecond))).Float64()
+		st.DelaysFloat[i] = ms
+	}
+
+	// compute the 95th percentile delay for each queue
+	st.P95Delays = make([]int64, len(blitz.limiters))
+	for i, s := range blitz.stats {
+		p, _ := s.Percentile(95).Int64()
+		st.P95Delays[i] = time.Duration(p).Milliseconds()
+	}
+
+	// report the window of the statistics for each queue
+	st.StatsWindows = make([]int64, len(blitz.stats))
+	for i, s := range blitz.stats {
+		st.StatsWindows[i] = s.Window().Milliseconds()
+	}
+
+	// read the reservation counters for each queue
+	st.ReservationsIssued = make([]int64, len(blitz.limiters))
+	st.ReservationsUsed = make([]int64, len(blitz.limiters))
+	for i := range blitz.counters {
+		st.ReservationsIssued[i] = int64(blitz.counters[i].issued.Load())
+		st.ReservationsUsed[i] = int64(blitz.counters[i].used.Load())
+	}
+
+	// read the concurrent requests of each queue
+	st.Concurrent = make([]int64, len(blitz.limiters))
+	for i := range blitz.counters {
+		st.Concurrent[i] = blitz.counters[i].inflight.Load()
+	}
+
+	// and group them by queue
+	st.Queues = make([]QueueStatus, len(blitz.queues))
+	for i := range st.Queues {
+		st.Queues[i] = QueueStatus{
+			Index:              i,
+			Name:               st.Names[i],
+			Slots:              st.Slots[i],
+			AvgDelayMs:         st.DelaysFloat[i],
+			P95Ms:              st.P95Delays[i],
+			StatsWindowMs:      st.StatsWindows[i],
+			ReservationsIssued: st.ReservationsIssued[i],
+			ReservationsUsed:   st.ReservationsUsed[i],
+			Concurrent:         st.Concurrent[i],
+			QueueLength:        blitz.counters[i].waiting.Load(),
+			Series:             make(map[string]float64),
+		}
+	}
+
+	// average each series, reporting the built-in ones in their own fields
+	for _, series := range blitz.allSeries() {
+		for i, s := range series.stats {
+			average, _ := s.Average().Float64()
+			switch series {
+			case blitz.backendLatency:
+				st.Queues[i].BackendLatencyMs = average
+			case blitz.backendTTFB:
+				st.Queues[i].BackendTTFBMs = average
+			default:
+				st.Queues[i].Series[series.name] = average
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,110 @@
+package blitz
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var (
+	errInvalidFormat    = errors.New("invalid signature format")
+	errInvalidSignature = errors.New("invalid signature")
+	errInvalidWindow    = errors.New("reservation is valid until before it is valid from")
+)
+
+// token is the content of a reservation token
+type token struct {
+	From, Until time.Time         // times the token is valid from and until
+	Queue       int               // index of the queue the token was issued for
+	Nonce       [nonceLength]byte // random nonce to identify the token
+	Binding     binding           // request the token is bound to, if any
+}
+
+const nonceLength = 16
+
+// tokenVersion is the version of the token format.
+// It is stored in the first byte of each message, and must be changed whenever the format changes.
+const tokenVersion = 1
+
+// tokenVersionBound is the version of tokens bound to a request.
+// They use the format of tokenVersion, followed by the binding.
+const tokenVersionBound = 2
+
+var errUnsupportedTokenVersion = errors.New("unsupported token version")
+
+var (
+	messageLength      = 1 + 3*(64/8) + nonceLength                                // length of the reservation, a version byte, 3 64-bit ints and a nonce
+	boundMessageLength = messageLength + bindingLength                             // length of a reservation bound to a request
+	maxEncodedLength   = base64.RawURLEncoding.EncodedLen(naclSignatureLength) * 2 // maximum length of base64 accepted, to allow for future versions
+)
+
+// marshal encodes the token into a message, storing times as UTC.
+func (t token) marshal() []byte {
+	bound := t.Binding != binding{}
+
+	message := make([]byte, messageLength, boundMessageLength)
+	message[0] = tokenVersion
+	if bound {
+		message[0] = tokenVersionBound
+	}
+	binary.LittleEndian.PutUint64(message[1:9], uint64(t.From.UTC().UnixMilli()))
+	binary.LittleEndian.PutUint64(message[9:17], uint64(t.Until.UTC().UnixMilli()))
+	binary.LittleEndian.PutUint64(message[17:25], uint64(t.Queue))
+	copy(message[25:], t.Nonce[:])
+	if bound {
+		message = append(message, t.Binding[:]...)
+	}
+	return message
+}
+
+// unmarshal decodes a message created by marshal into this token.
+func (t *token) unmarshal(message []byte) error {
+	if len(message) == 0 {
+		return errInvalidFormat
+	}
+
+	switch message[0] {
+	case tokenVersion, tokenVersionBound:
+		bound, length := message[0] == tokenVersionBound, messageLength
+		if bound {
+			length = boundMessageLength
+		}
+		if len(message) != length {
+			return errInvalidFormat
+		}
+		t.From = time.UnixMilli(int64(binary.LittleEndian.Uint64(message[1:9]))).UTC()
+		t.Until = time.UnixMilli(int64(binary.LittleEndian.Uint64(message[9:17]))).UTC()
+		t.Queue = int(binary.LittleEndian.Uint64(message[17:25]))
+		copy(t.Nonce[:], message[25:messageLength])
+		if bound {
+			copy(t.Binding[:], message[messageLength:])
+		}
+
+		// the window must not be inverted, even if signed
+		if t.Until.Before(t.From) {
+			return errInvalidWindow
+		}
+		return nil
+	default:
+		return errUnsupportedTokenVersion
+	}
+}
+
+// encodeSigned encodes a signed message into a string, using url-safe base64.
+func encodeSigned(signed []byte) string {
+	return base64.RawURLEncoding.EncodeToString(signed)
+}
+
+// decodeSigned decodes a string created by encodeSigned.
+func decodeSigned(encoded string) ([]byte, error) {
+	if len(encoded) > maxEncodedLength {
+		return nil, errInvalidFormat
+	}
+
+	signed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidFormat
+	}
+	return signed, nil
+}
@@ -0,0 +1,40 @@
+package blitz
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDecodeInvalidWindow(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"nacl", nil},
+		{"hmac", []Option{WithHMACKey([]byte("0123456789abcdef0123456789abcdef"))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			blitz := newTestBlitz(t, append(tt.opts, WithClock(clock))...)
+
+			// signed with the key of the server, but valid until before it is valid from
+			now := clock.Now()
+			encoded, err := blitz.signer.Encode(token{From: now.Add(time.Second), Until: now})
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+
+			if _, err := blitz.signer.Decode(encoded); !errors.Is(err, errInvalidWindow) {
+				t.Errorf("Decode() error = %v, want %v", err, errInvalidWindow)
+			}
+
+			w, body := sendRequest(t, blitz, map[string]string{HeaderReservation: encoded})
+			if w.Code != http.StatusBadRequest || body.Code != CodeBadReservation {
+				t.Errorf("response = %d %q, want %d %q", w.Code, body.Code, http.StatusBadRequest, CodeBadReservation)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package blitz
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TracerProvider provides tracers used to trace requests, see [WithTracerProvider].
+//
+// The tracing interfaces mirror a subset of OpenTelemetry, without depending on it.
+// They can be implemented by a thin adapter around an OpenTelemetry tracer provider and propagator.
+type TracerProvider interface {
+	// Tracer returns the tracer with the given instrumentation name.
+	Tracer(name string) Tracer
+}
+
+// Tracer starts spans.
+type Tracer interface {
+	// Start starts a new span with the given name as a child of the span in ctx, if any.
+	// It returns a copy of ctx containing the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single operation within a trace.
+type Span interface {
+	// SetAttributes sets the given attributes on the span.
+	SetAttributes(attrs ...slog.Attr)
+
+	// End completes the span.
+	// It is called exactly once.
+	End()
+}
+
+// Propagator reads and writes trace context from and to the headers of a request.
+type Propagator interface {
+	// Extract returns a copy of ctx containing the trace context read from header.
+	Extract(ctx context.Context, header http.Header) context.Context
+
+	// Inject writes the trace context in ctx into header.
+	Inject(ctx context.Context, header http.Header)
+}
+
+// tracerName is the instrumentation name of the tracer used by blitz
+const tracerName = "github.com/fau-cdi/blitz"
+
+// Names and attributes of spans.
+const (
+	spanAdmit   = "blitz.admit"
+	spanReserve = "blitz.reserve"
+
+	attrQueue    = "blitz.queue"
+	attrDelayMs  = "blitz.delay_ms"
+	attrRejected = "blitz.rejected"
+)
+
+// requestSpan is the span of a request, which may be ended more than once
+type requestSpan struct {
+	span Span
+	once sync.Once
+}
+
+// startSpan starts a span with the given name for the given request, continuing the trace of the client if any.
+// It returns a copy of the request containing the span, or the request itself if tracing is disabled.
+func (blitz *Blitz) startSpan(r *http.Request, name string) *http.Request {
+	if blitz.tracer == nil {
+		return r
+	}
+
+	ctx := r.Context()
+	if blitz.propagator != nil {
+		ctx = blitz.propagator.Extract(ctx, r.Header)
+	}
+	ctx, span := blitz.tracer.Start(ctx, name)
+	return r.WithContext(context.WithValue(ctx, spanContextKey, &requestSpan{span: span}))
+}
+
+// traceAdmission records the queue and delay of the given request in its span, if any.
+func traceAdmission(r *http.Request, queue int, delay time.Duration) {
+	if span, ok := r.Context().Value(spanContextKey).(*requestSpan); ok {
+		span.span.SetAttributes(slog.Int(attrQueue, queue), slog.Int64(attrDelayMs, delay.Milliseconds()))
+	}
+}
+
+// traceRejection records that the given request was rejected in its span, if any.
+func traceRejection(r *http.Request) {
+	if span, ok := r.Context().Value(spanContextKey).(*requestSpan); ok {
+		span.span.SetAttributes(slog.Bool(attrRejected, true))
+	}
+}
+
+// endSpan ends the span of the given request, if any.
+func endSpan(r *http.Request) {
+	if span, ok := r.Context().Value(spanContextKey).(*requestSpan); ok {
+		span.once.Do(span.span.End)
+	}
+}
+
+// injectSpan writes the trace context of the given request into its headers, to propagate it to the handler.
+func (blitz *Blitz) injectSpan(r *http.Request) {
+	if blitz.propagator != nil && blitz.tracer != nil {
+		blitz.propagator.Inject(r.Context(), r.Header)
+	}
+}
@@ -0,0 +1,89 @@
+package blitz
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTracer records the attributes set on the spans it starts.
+type fakeTracer struct {
+	m     sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	name  string
+	attrs []slog.Attr
+	ended int
+}
+
+func (tr *fakeTracer) Tracer(name string) Tracer { return tr }
+
+func (tr *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	tr.m.Lock()
+	defer tr.m.Unlock()
+
+	span := &fakeSpan{name: name}
+	tr.spans = append(tr.spans, span)
+	return ctx, span
+}
+
+func (s *fakeSpan) SetAttributes(attrs ...slog.Attr) { s.attrs = append(s.attrs, attrs...) }
+func (s *fakeSpan) End()                             { s.ended++ }
+
+// count returns the number of times the attribute with the given key was set.
+func (s *fakeSpan) count(key string) int {
+	n := 0
+	for _, attr := range s.attrs {
+		if attr.Key == key {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTraceAdmissionOnce(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers func(blitz *Blitz) map[string]string
+	}{
+		{"regular", func(blitz *Blitz) map[string]string {
+			return nil
+		}},
+		{"reservation", func(blitz *Blitz) map[string]string {
+			_, rs := requestReservation(t, blitz, nil)
+			return map[string]string{HeaderReservation: rs.XBlitzReservation}
+		}},
+		{"upgrade", func(blitz *Blitz) map[string]string {
+			return map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracer := &fakeTracer{}
+			blitz := newTestBlitz(t, WithClock(newFakeClock()), WithRefill(time.Second), WithTracerProvider(tracer, nil), WithUpgradeBypass(true))
+
+			headers := tt.headers(blitz)
+			tracer.spans = nil
+
+			if w, _ := sendRequest(t, blitz, headers); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if len(tracer.spans) != 1 {
+				t.Fatalf("started %d spans, want 1", len(tracer.spans))
+			}
+
+			span := tracer.spans[0]
+			if span.name != spanAdmit || span.ended != 1 {
+				t.Errorf("span %q ended %d times, want %q ended once", span.name, span.ended, spanAdmit)
+			}
+			if queue, delay := span.count(attrQueue), span.count(attrDelayMs); queue != 1 || delay != 1 {
+				t.Errorf("queue recorded %d times, delay %d times, want once each", queue, delay)
+			}
+		})
+	}
+}
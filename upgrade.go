@@ -0,0 +1,30 @@
+package blitz
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isUpgrade checks if the given request asks to upgrade the connection to a different protocol, such as a WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade forwards a request upgrading the connection without waiting.
+func (blitz *Blitz) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	queue := blitz.selectQueue(r)
+	blitz.logEvent(event{Name: eventForward, Client: blitz.clientAddr(r), Queue: queue})
+	blitz.counters[queue].forwarded.Add(1)
+	traceAdmission(r, queue, 0)
+	blitz.forward(w, r, queue, 0)
+}
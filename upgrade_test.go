@@ -0,0 +1,212 @@
+package blitz
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoUpgradeHandler upgrades every connection to a protocol that echoes each line sent by the client.
+// It returns once the client closes the connection.
+var echoUpgradeHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	io.WriteString(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	rw.Flush()
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		rw.WriteString(line)
+		rw.Flush()
+	}
+})
+
+// dialUpgrade opens a connection to the given server and upgrades it using echoUpgradeHandler, passing the given headers.
+func dialUpgrade(t *testing.T, server *httptest.Server, headers map[string]string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Upgrade", "echo")
+	r.Header.Set("Connection", "Upgrade")
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	r.Write(conn)
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+	return conn, reader
+}
+
+// echo sends a line over the given upgraded connection, and checks that it is echoed.
+func echo(t *testing.T, conn net.Conn, reader *bufio.Reader, line string) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, line+"\n"); err != nil {
+		t.Fatalf("writing %q: %v", line, err)
+	}
+	got, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading %q: %v", line, err)
+	}
+	if got != line+"\n" {
+		t.Errorf("echo = %q, want %q", got, line+"\n")
+	}
+}
+
+func TestServeUpgradeLongLived(t *testing.T) {
+	const (
+		every = 10 * time.Millisecond // refill, maximum hold and confirmation timeout
+		life  = 20 * every            // how long the connection is kept alive
+	)
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		reserve bool // upgrade using a reservation that is not yet valid
+	}{
+		{"bypass", []Option{WithUpgradeBypass(true)}, false},
+		{"upgrade queue", []Option{WithUpgradeQueue(1)}, false},
+		{"early reservation", []Option{WithClockSkew(0)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blitz := newTestBlitz(t, append(tt.opts, WithQueues([]uint64{1, 1}), WithRefill(every), WithMaxHold(every), WithReservationConfirm(every))...)
+			blitz.Handler = echoUpgradeHandler
+
+			server := httptest.NewServer(blitz)
+			defer server.Close()
+
+			// the second reservation is only valid once the queue refilled, so the upgrade waits for it
+			var headers map[string]string
+			if tt.reserve {
+				requestReservation(t, blitz, nil)
+				_, rs := requestReservation(t, blitz, nil)
+				if !rs.Success || rs.DelayInMilliseconds == 0 {
+					t.Fatalf("reservation = %q with delay %dms, want a delayed reservation", rs.Code, rs.DelayInMilliseconds)
+				}
+				headers = map[string]string{HeaderReservation: rs.XBlitzReservation}
+			}
+
+			conn, reader := dialUpgrade(t, server, headers)
+			defer conn.Close()
+
+			// talk for longer than any timer of blitz runs
+			start := time.Now()
+			for i := 0; time.Since(start) < life; i++ {
+				echo(t, conn, reader, fmt.Sprintf("before close %d", i))
+				time.Sleep(every / 2)
+			}
+
+			// closing blitz does not affect connections already forwarded
+			blitz.Close()
+			res, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("status after Close() = %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+			}
+			for i := 0; i < 5; i++ {
+				echo(t, conn, reader, fmt.Sprintf("after close %d", i))
+				time.Sleep(every)
+			}
+
+			// shutting down waits for the connection to be closed
+			ctx, cancel := context.WithTimeout(context.Background(), 2*every)
+			defer cancel()
+			if err := blitz.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Shutdown() with an open connection = %v, want %v", err, context.DeadlineExceeded)
+			}
+			echo(t, conn, reader, "after shutdown")
+
+			conn.Close()
+			if err := blitz.Shutdown(context.Background()); err != nil {
+				t.Errorf("Shutdown() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestUpgradeQueue(t *testing.T) {
+	if _, err := NewWithOptions(okHandler, WithQueues([]uint64{1, 1}), WithUpgradeQueue(2)); !errors.Is(err, errInvalidUpgrade) {
+		t.Errorf("NewWithOptions() with a missing upgrade queue error = %v, want %v", err, errInvalidUpgrade)
+	}
+
+	tests := []struct {
+		name    string
+		queue   int
+		upgrade bool
+		headers map[string]string
+
+		want int
+	}{
+		{"upgrade", 1, true, nil, 1},
+		{"upgrade claiming a queue", 1, true, map[string]string{HeaderQueue: "2"}, 1},
+		{"regular", 1, false, nil, 0},
+		{"regular claiming a queue", 1, false, map[string]string{HeaderQueue: "2"}, 2},
+		{"upgrade without upgrade queue", -1, true, map[string]string{HeaderQueue: "2"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blitz := newTestBlitz(t, WithQueues([]uint64{1, 1, 1}), WithUpgradeQueue(tt.queue))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.upgrade {
+				r.Header.Set("Upgrade", "websocket")
+				r.Header.Set("Connection", "keep-alive, Upgrade")
+			}
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			if got := blitz.selectQueue(r); got != tt.want {
+				t.Errorf("selectQueue() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// upgrading requests are limited by their own queue, without using up slots of higher ones
+	t.Run("limits", func(t *testing.T) {
+		clock := newFakeClock()
+		blitz := newTestBlitz(t, WithClock(clock), WithQueues([]uint64{1, 1}), WithRefill(time.Hour), WithUpgradeQueue(0), WithMaxHold(time.Second))
+
+		upgrade := map[string]string{"Upgrade": "websocket", "Connection": "Upgrade"}
+		for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+			if w, body := sendRequest(t, blitz, upgrade); w.Code != want {
+				t.Errorf("upgrade = %d %q, want %d", w.Code, body.Code, want)
+			}
+		}
+		if w, body := sendRequest(t, blitz, map[string]string{HeaderQueue: "1"}); w.Code != http.StatusOK {
+			t.Errorf("regular = %d %q, want %d", w.Code, body.Code, http.StatusOK)
+		}
+	})
+}
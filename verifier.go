@@ -0,0 +1,30 @@
+package blitz
+
+import "time"
+
+// Verifier verifies reservations issued by a server, without running a server itself.
+// It allows other services, such as gateways in front of several backends, to check reservations on their own.
+//
+// A Verifier only accepts reservations signed using the private key belonging to a public key, see [Blitz.PublicKey].
+// It is safe for concurrent use.
+type Verifier struct {
+	signer *naclSigner
+}
+
+// NewVerifier creates a new verifier for reservations signed using the private key belonging to pub.
+func NewVerifier(pub [32]byte) *Verifier {
+	return &Verifier{signer: &naclSigner{pubKey: &pub}}
+}
+
+// Verify checks the signature of the given reservation, as sent in the [HeaderReservation] header.
+// It returns the time the reservation is valid from and until, in UTC.
+//
+// Verify does not check that the reservation is currently valid, as the tolerance for clock skew is up to the caller.
+// Neither does it check the queue or request a reservation is bound to, or whether it was used before.
+func (v *Verifier) Verify(reservation string) (from, until time.Time, err error) {
+	t, err := v.signer.Decode(reservation)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return t.From, t.Until, nil
+}
@@ -0,0 +1,88 @@
+package blitz
+
+import (
+	"sync"
+	"time"
+)
+
+// cachingSigner is a signer that caches successfully decoded tokens, so that tokens used repeatedly are only verified once.
+// Tokens are cached until they expire, see [WithVerifyCache].
+//
+// Caching only skips verifying the signature.
+// Checks of the queue, binding, expiry and replay of a token happen on every use.
+type cachingSigner struct {
+	signer
+	clock Clock
+	skew  time.Duration // tolerance added to the expiry of cached tokens
+	size  int           // maximum number of cached tokens
+
+	m       sync.Mutex
+	tokens  map[string]token
+	nextGC  time.Time // earliest expiry of any cached token, when expired tokens should be dropped
+	hasNext bool      // nextGC is set
+}
+
+func newCachingSigner(s signer, clock Clock, skew time.Duration, size int) *cachingSigner {
+	return &cachingSigner{
+		signer: s,
+		clock:  clock,
+		skew:   skew,
+		size:   size,
+		tokens: make(map[string]token, size),
+	}
+}
+
+// Decode implements signer.
+func (cs *cachingSigner) Decode(encoded string) (token, error) {
+	now := cs.clock.Now()
+
+	cs.m.Lock()
+	t, ok := cs.tokens[encoded]
+	cs.m.Unlock()
+	if ok && now.Before(t.Until.Add(cs.skew)) {
+		return t, nil
+	}
+
+	t, err := cs.signer.Decode(encoded)
+	if err != nil {
+		return t, err
+	}
+
+	cs.add(encoded, t, now)
+	return t, nil
+}
+
+// add caches the given token decoded from encoded, unless the cache is full.
+func (cs *cachingSigner) add(encoded string, t token, now time.Time) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+
+	// drop expired tokens once the first one expires.
+	// until then, a full cache holds no expired tokens, so scanning it would be wasted.
+	if cs.hasNext && !now.Before(cs.nextGC) {
+		cs.gc(now)
+	}
+	if len(cs.tokens) >= cs.size {
+		return
+	}
+
+	cs.tokens[encoded] = t
+	if expires := t.Until.Add(cs.skew); !cs.hasNext || expires.Before(cs.nextGC) {
+		cs.nextGC, cs.hasNext = expires, true
+	}
+}
+
+// gc drops all expired tokens, and updates nextGC accordingly.
+func (cs *cachingSigner) gc(now time.Time) {
+	cs.hasNext = false
+	for encoded, t := range cs.tokens {
+		expires := t.Until.Add(cs.skew)
+		if !now.Before(expires) {
+			delete(cs.tokens, encoded)
+			continue
+		}
+		if !cs.hasNext || expires.Before(cs.nextGC) {
+			cs.nextGC, cs.hasNext = expires, true
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package blitz
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCachingSignerFull(t *testing.T) {
+	clock := newFakeClock()
+	blitz := newTestBlitz(t, WithClock(clock), WithVerifyCache(2))
+	cs := blitz.signer.(*cachingSigner)
+
+	now := clock.Now()
+	encode := func(until time.Duration) string {
+		encoded, err := blitz.signer.Encode(token{From: now, Until: now.Add(until)})
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+		return encoded
+	}
+	decode := func(encoded string) {
+		if _, err := cs.Decode(encoded); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+	}
+
+	decode(encode(time.Second))
+	decode(encode(2 * time.Second))
+	if len(cs.tokens) != 2 {
+		t.Fatalf("cache holds %d tokens, want 2", len(cs.tokens))
+	}
+
+	// full and nothing expired => not cached
+	third := encode(3 * time.Second)
+	decode(third)
+	if _, ok := cs.tokens[third]; ok || len(cs.tokens) != 2 {
+		t.Errorf("full cache holds %d tokens, want the 2 cached first", len(cs.tokens))
+	}
+
+	// the first token expired => dropped to make room
+	clock.Advance(time.Second + DefaultClockSkew)
+	decode(third)
+	if _, ok := cs.tokens[third]; !ok || len(cs.tokens) != 2 {
+		t.Errorf("cache holds %d tokens after the first expired, want the last 2", len(cs.tokens))
+	}
+}
+
+// BenchmarkUseReservation benchmarks using a reservation repeatedly, with and without caching verified reservations.
+func BenchmarkUseReservation(b *testing.B) {
+	for _, size := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			blitz := newTestBlitz(b, WithVerifyCache(size))
+
+			now := time.Now()
+			encoded, err := blitz.signer.Encode(token{From: now.Add(-time.Second), Until: now.Add(time.Hour)})
+			if err != nil {
+				b.Fatalf("Encode() error = %v", err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := blitz.useReservation(context.Background(), encoded, -1, binding{}, ""); err != nil {
+					b.Fatalf("useReservation() error = %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkVerifyCacheFullMiss benchmarks decoding distinct reservations while the cache is full of unexpired ones.
+func BenchmarkVerifyCacheFullMiss(b *testing.B) {
+	const size = 10_000
+	blitz := newTestBlitz(b, WithVerifyCache(size))
+	cs := blitz.signer.(*cachingSigner)
+
+	now := time.Now()
+	encoded := make([]string, size+b.N)
+	for i := range encoded {
+		var err error
+		encoded[i], err = blitz.signer.Encode(token{From: now, Until: now.Add(time.Hour), Nonce: [nonceLength]byte{byte(i), byte(i >> 8), byte(i >> 16), byte(i >> 24)}})
+		if err != nil {
+			b.Fatalf("Encode() error = %v", err)
+		}
+	}
+	for _, e := range encoded[:size] {
+		cs.Decode(e)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cs.Decode(encoded[size+i]); err != nil {
+			b.Fatalf("Decode() error = %v", err)
+		}
+	}
+}